@@ -0,0 +1,198 @@
+package command_socket
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Name of the cookie that carries the access token for browsers
+const TOKEN_COOKIE = "wschat_token"
+
+// AccessControl decides who may use the server.
+type AccessControl struct {
+	// Origins allowed to open websockets and call the API from a browser,
+	// such as "https://example.com", or "*" for any. When empty, only pages
+	// served by this server are allowed.
+	AllowedOrigins []string
+
+	// Shared secret required for the websocket and the API, if not empty.
+	// It is accepted as a "Bearer" Authorization header, a token query
+	// parameter, or the TOKEN_COOKIE cookie.
+	Token string
+
+	// Client addresses that are allowed and denied. Denied addresses take
+	// precedence, and when the allow list is empty, all other addresses
+	// are allowed.
+	AllowIPs []*net.IPNet
+	DenyIPs  []*net.IPNet
+}
+
+// ParseNetworks parses a list of IP addresses and CIDR networks. A single
+// address is a network of its own, and IPv4-mapped IPv6 addresses are
+// treated as IPv4 addresses.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			switch {
+			case ip == nil:
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			case ip.To4() != nil:
+				nets = append(nets, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+			default:
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func reject(r *http.Request, reason string) {
+	slog.Warn("Rejected request", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path, "reason", reason)
+}
+
+// allowIP checks the client address against the allow and deny lists.
+func (a *AccessControl) allowIP(r *http.Request) bool {
+	if a == nil || (len(a.AllowIPs) == 0 && len(a.DenyIPs) == 0) {
+		return true
+	}
+	ip := clientIP(r)
+	if ip == nil {
+		reject(r, "unknown client address")
+		return false
+	}
+	if inNetworks(ip, a.DenyIPs) {
+		reject(r, "address is denied")
+		return false
+	}
+	if len(a.AllowIPs) > 0 && !inNetworks(ip, a.AllowIPs) {
+		reject(r, "address is not allowed")
+		return false
+	}
+	return true
+}
+
+// checkOrigin is used by the websocket upgrader and the API. Requests
+// without an Origin header do not come from a browser and are allowed.
+func (a *AccessControl) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if a == nil || len(a.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+	} else {
+		for _, allowed := range a.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+	}
+	reject(r, "origin "+origin+" is not allowed")
+	return false
+}
+
+// requestToken returns the token presented with the request.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	if c, err := r.Cookie(TOKEN_COOKIE); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func (a *AccessControl) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// allowToken checks the token, if one is required.
+func (a *AccessControl) allowToken(r *http.Request) bool {
+	if a == nil || a.Token == "" {
+		return true
+	}
+	if !a.validToken(requestToken(r)) {
+		reject(r, "missing or wrong token")
+		return false
+	}
+	return true
+}
+
+// authorize runs all checks for the websocket and the API, and responds
+// with an error when one fails. Origins of websocket requests are checked
+// by the upgrader.
+func (a *AccessControl) authorize(w http.ResponseWriter, r *http.Request, checkOrigin bool) bool {
+	switch {
+	case !a.allowIP(r):
+		apiError(w, http.StatusForbidden, "access denied")
+	case checkOrigin && !a.checkOrigin(r):
+		apiError(w, http.StatusForbidden, "origin not allowed")
+	case !a.allowToken(r):
+		apiError(w, http.StatusUnauthorized, "missing or wrong token")
+	default:
+		return true
+	}
+	return false
+}
+
+// Protect wraps a handler for other resources, such as the chat window. It
+// applies the address lists, and when the page is opened with a valid token
+// in the query string, it stores the token in a cookie so that the page can
+// open the websocket. The cookie is only sent back over TLS when the page
+// was served over TLS.
+func (a *AccessControl) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowIP(r) {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		if a != nil && a.Token != "" {
+			if t := r.URL.Query().Get("token"); t != "" && a.validToken(t) {
+				http.SetCookie(w, &http.Cookie{
+					Name:     TOKEN_COOKIE,
+					Value:    t,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,30 @@
+package command_socket
+
+import (
+	"math"
+	"time"
+)
+
+// Largest packet the radio can send, in bytes
+const MAX_PACKET_SIZE = 255
+
+// Number of preamble symbols sent before each packet
+const preambleSymbols = 8
+
+// timeOnAir returns how long it takes to transmit a packet of the given size
+// with the radio parameters, using the LoRa modem formula with an explicit
+// header and a CRC.
+func timeOnAir(params RadioParams, size int) time.Duration {
+	sf := float64(params.spreadingFactor)
+	symbol := math.Pow(2, sf) / float64(params.bandwidth*1000)
+
+	// Low data rate optimization is required for long symbols
+	de := 0.0
+	if symbol > 0.016 {
+		de = 1
+	}
+
+	payload := math.Ceil((8*float64(size)-4*sf+28+16)/(4*(sf-2*de))) * float64(params.codingRate)
+	symbols := preambleSymbols + 4.25 + 8 + math.Max(payload, 0)
+	return time.Duration(symbols * symbol * float64(time.Second))
+}
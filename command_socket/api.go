@@ -0,0 +1,182 @@
+package command_socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Default time a radio started by the REST API keeps running
+	DEFAULT_API_LINGER = 1 * time.Minute
+
+	// Maximum time to wait for the chat program to accept a message
+	apiWriteWait = 10 * time.Second
+
+	// Maximum size of a request body
+	apiMaxBody = 4096
+)
+
+// lease keeps a radio running on behalf of the REST API. It is attached as a
+// client without a socket and detached when the timer fires.
+type lease struct {
+	c     *client
+	timer *time.Timer
+}
+
+// postedMessage is the body of POST /api/messages
+type postedMessage struct {
+	Callsign string `json:"callsign"`
+	Body     string `json:"body"`
+}
+
+// acquire returns the radio for the parameters, starting it if needed, and
+// keeps it running for at least APILinger.
+func (h *Hub) acquire(params RadioParams) *Radio {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if l, ok := h.leases[params]; ok {
+		select {
+		case <-l.c.radio.done:
+			// The radio gave up, replace the lease
+			l.timer.Stop()
+			delete(h.leases, params)
+		default:
+			l.timer.Reset(h.APILinger)
+			return l.c.radio
+		}
+	}
+
+	l := &lease{c: newClient(context.Background(), false, slog.With("api", true))}
+	l.c.send = nil
+	l.c.radio = h.join(params, l.c, nil)
+	if l.c.radio == nil {
+		return nil
+	}
+	l.timer = time.AfterFunc(h.APILinger, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.leases[params] == l {
+			delete(h.leases, params)
+			h.leave(l.c.radio, l.c)
+		}
+	})
+	h.leases[params] = l
+	return l.c.radio
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"error": msg})
+}
+
+// ServeMessages implements the /api/messages endpoint. GET returns the
+// recent lines for a radio configuration from the history, and POST sends a
+// message to the chat program. The radio parameters are passed in the query
+// string, the same way as for /sock.
+func (h *Hub) ServeMessages(w http.ResponseWriter, r *http.Request) {
+	if !h.Access.authorize(w, r, true) {
+		return
+	}
+
+	q := r.URL.Query()
+	params, err := defaultRadioParams.withQuery(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid radio parameters",
+			"fields": err,
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getMessages(w, r, params)
+	case http.MethodPost:
+		h.postMessage(w, r, params)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Hub) getMessages(w http.ResponseWriter, r *http.Request, params RadioParams) {
+	q := r.URL.Query()
+	var errs ValidationError
+	since, err := parseSeqParam(q, "since")
+	if err != nil {
+		errs = append(errs, FieldError{"since", q.Get("since"), "must be a sequence number"})
+	}
+	limit, err := parseIntParam(q, "limit", 0)
+	if err != nil || limit < 0 {
+		errs = append(errs, FieldError{"limit", q.Get("limit"), "must be a positive number"})
+	}
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid query parameters",
+			"fields": errs,
+		})
+		return
+	}
+
+	messages := []Frame{}
+	for _, e := range h.History.Since(params, since, limit) {
+		messages = append(messages, h.historyFrame(e))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"params":   params,
+		"messages": messages,
+	})
+}
+
+func (h *Hub) postMessage(w http.ResponseWriter, r *http.Request, params RadioParams) {
+	var m postedMessage
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	if err := d.Decode(&m); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"request body is too large, the limit is %d bytes", apiMaxBody))
+			return
+		}
+		apiError(w, http.StatusBadRequest, "request body must be a JSON object with callsign and body")
+		return
+	}
+	if strings.TrimSpace(m.Body) == "" {
+		apiError(w, http.StatusBadRequest, "body must not be empty")
+		return
+	}
+	if !utf8.ValidString(m.Body) || strings.ContainsAny(m.Body+m.Callsign, "\r\n") {
+		apiError(w, http.StatusBadRequest, "body and callsign must be a single line of text")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), apiWriteWait)
+	defer cancel()
+
+	radio := h.acquire(params)
+	if radio == nil {
+		apiError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	f := Frame{Callsign: m.Callsign, Body: m.Body}
+	e, err := radio.send(nil, "", f.inputLine(), ctx.Done())
+	if err == TOO_LONG {
+		apiError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"body is too long, the limit is %d characters", MAX_FRAGMENTED_LENGTH))
+		return
+	}
+	if err != nil {
+		radio.log.Warn("Could not deliver API message to the chat program", "err", err)
+		apiError(w, http.StatusServiceUnavailable, "radio is not available")
+		return
+	}
+	radio.log.Debug("API message sent", "seq", e.Seq, "body", e.Line)
+	writeJSON(w, http.StatusCreated, h.historyFrame(e))
+}
@@ -4,117 +4,223 @@ import (
 	"bufio"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
-	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
 var GARBLED = errors.New("garbled")
 
-func stdoutToOutput(r io.ReadCloser, outputIO chan<- []byte,
-	errorIO chan<- Error) {
+// Time given to the chat program to exit after being interrupted
+const killWait = 5 * time.Second
+
+func stdoutToOutput(log *slog.Logger, r io.ReadCloser, outputIO chan<- []byte,
+	errorIO chan<- Error, finished chan<- struct{}) {
+	defer close(finished)
 	defer r.Close()
-	log.Println("[STDOUT] Waiting")
+	log.Debug("Reading output")
 	s := bufio.NewScanner(r)
 	for s.Scan() {
-		msg := s.Bytes()
+		// The scanner reuses its buffer, so hand out a copy
+		msg := append([]byte(nil), s.Bytes()...)
 		if utf8.Valid(msg) {
-			log.Println("[outputIO] <- [STDOUT]", string(msg))
+			log.Debug("Line received", "body", string(msg))
+			metrics.messagesIn.inc()
+			metrics.messageSizeIn.observe(float64(len(msg)))
 			outputIO <- msg
 		} else {
+			metrics.garbled.inc()
 			errorIO <- Error{err: GARBLED, msg: "Last message was garbled"}
-			log.Println("[STDOUT] Invalid message received")
+			log.Warn("Garbled line received", "size", len(msg))
 		}
 	}
-	log.Println("No more messages to send")
 	if s.Err() != nil {
+		log.Warn("Cannot read from chat program", "err", s.Err())
 		errorIO <- Error{err: s.Err(), msg: "Cannot read from chat program"}
-		log.Println("[outputIO] Closing")
-		close(outputIO)
 	}
-	log.Println("[STDOUT] Done")
+	log.Debug("Output closed")
 }
 
-func inputToStdin(w io.WriteCloser, inputIO <-chan []byte, errorIO chan<- Error) {
+// stderrToDiag reads the diagnostics that the chat program writes to its
+// standard error. They are not chat messages, so they are logged and passed
+// on as they are, even if they are not valid UTF-8.
+func stderrToDiag(log *slog.Logger, r io.ReadCloser, diagIO chan<- string, finished chan<- struct{}) {
+	defer close(finished)
+	defer r.Close()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.ToValidUTF8(s.Text(), "\uFFFD")
+		log.Info("Chat program diagnostic", "line", line)
+		metrics.diagnostics.inc()
+		diagIO <- line
+	}
+	if s.Err() != nil {
+		log.Warn("Cannot read diagnostics from chat program", "err", s.Err())
+	}
+	log.Debug("Diagnostics closed")
+}
+
+func inputToStdin(log *slog.Logger, w io.WriteCloser, inputIO <-chan []byte, errorIO chan<- Error,
+	quit <-chan struct{}, exited <-chan struct{}) {
 	defer w.Close()
 	for {
-		log.Println("[inputIO] Waiting")
-		msg, more := <-inputIO
-		if more {
-			log.Println("[inputIO] -> [STDIN]", string(msg))
+		select {
+		case msg := <-inputIO:
+			log.Debug("Writing line", "body", string(msg))
+			size := len(msg)
 			msg = append(msg, '\n')
 			if _, err := w.Write(msg); err != nil {
+				log.Warn("Cannot send to chat program", "err", err)
+				metrics.stdinErrors.inc()
 				errorIO <- Error{err: err, msg: "Cannot send to chat program"}
 				return
 			}
-			log.Println("[STDIN] Wrote")
-		} else {
-			log.Println("[STDIN] Done")
+			metrics.messagesOut.inc()
+			metrics.messageSizeOut.observe(float64(size))
+		case <-quit:
+			log.Debug("Input closed")
+			return
+		case <-exited:
+			log.Debug("Input closed, process exited")
 			return
 		}
 	}
 }
 
+// ExitStatus describes how a chat program run ended.
+type ExitStatus struct {
+	// Whether the process was started at all
+	Started bool
+	// Exit code, or -1 if the process was killed by a signal
+	Code int
+	// Human readable description such as "exit status 1" or "signal: killed"
+	Reason string
+	// How long the process was running
+	Uptime time.Duration
+}
+
+// SpawnChat runs the chat program with the given radio parameters until it
+// exits or quit is closed. The started channel is closed once the process is
+// running. Lines written to inputIO are passed to the program's input, its
+// output is written to outputIO and its standard error to diagIO. SpawnChat
+// returns only after all output has been delivered.
 func SpawnChat(
-	cmd string,
+	cmd Command,
 	params RadioParams,
-	done chan struct{},
-	inputIO chan []byte,
-	outputIO chan []byte,
-	errIO chan Error) {
+	quit <-chan struct{},
+	started chan<- struct{},
+	inputIO <-chan []byte,
+	outputIO chan<- []byte,
+	diagIO chan<- string,
+	errIO chan<- Error) ExitStatus {
 
-	defer close(done)
+	log := radioLogger(params)
+	proc, err := cmd.build(params)
+	if err != nil {
+		log.Error("Invalid command line for chat program", "err", err)
+		errIO <- Error{err: err, msg: "Invalid command line for chat program"}
+		return ExitStatus{Reason: err.Error()}
+	}
 
-	// Create a common output pipe
+	// Create separate output pipes, so that diagnostics never end up in
+	// the middle of a chat line
 	outr, outw, err := os.Pipe()
 	if err != nil {
-		errIO <- Error{err: err, msg: "Failed to open common output pipe"}
-		close(done)
-
+		errIO <- Error{err: err, msg: "Failed to open output pipe"}
+		return ExitStatus{Reason: err.Error()}
+	}
+	errr, errw, err := os.Pipe()
+	if err != nil {
+		errIO <- Error{err: err, msg: "Failed to open error pipe"}
+		outr.Close()
+		outw.Close()
+		return ExitStatus{Reason: err.Error()}
+	}
+	closePipes := func() {
+		outr.Close()
+		outw.Close()
+		errr.Close()
+		errw.Close()
 	}
 
 	// Start the command and bind to input/output pipes
-	proc := exec.Command(
-		cmd,
-		"-f",
-		strconv.FormatFloat(params.frequency, 'f', -1, 32),
-		"-b",
-		strconv.Itoa(Bandwidths[params.bandwidth]),
-		"-s",
-		strconv.Itoa(SpreadingFactors[params.spreadingFactor]),
-		"-c",
-		strconv.Itoa(CodingRates[params.codingRate]),
-	)
 	inw, err := proc.StdinPipe()
 	if err != nil {
 		errIO <- Error{err: err, msg: "Failed to open input pipe for command"}
-		close(done)
-		return
+		closePipes()
+		return ExitStatus{Reason: err.Error()}
 	}
 	proc.Stdout = outw
-	proc.Stderr = outw
+	proc.Stderr = errw
 	if err = proc.Start(); err != nil {
+		log.Error("Could not start the chat program", "path", cmd.Path, "err", err)
 		errIO <- Error{err: err, msg: "Could not start the process"}
-		close(done)
+		closePipes()
+		return ExitStatus{Reason: err.Error()}
 	}
+	startTime := time.Now()
+	metrics.spawned.inc()
+	close(started)
 
-	log.Println("[CMD] Spawned process", proc.Process.Pid, cmd, proc.Args)
+	// The child holds its own copies of the write ends, so the readers see
+	// EOF as soon as the process exits
+	outw.Close()
+	errw.Close()
 
-	go stdoutToOutput(outr, outputIO, errIO)
-	inputToStdin(inw, inputIO, errIO)
+	log = log.With("pid", proc.Process.Pid)
+	log.Info("Spawned chat program", "path", cmd.Path, "args", proc.Args[1:])
 
-	if err := proc.Process.Signal(os.Interrupt); err != nil {
-		log.Println("[PROC] Cannot interrupt process")
-		if err := proc.Process.Signal(os.Kill); err != nil {
-			log.Println("[PROC] Cannot kill process")
+	// Reap the process in the background so that a crash is noticed even
+	// when nobody is writing to it
+	exited := make(chan struct{})
+	var state *os.ProcessState
+	go func() {
+		var err error
+		if state, err = proc.Process.Wait(); err != nil {
+			log.Warn("Cannot wait for chat program", "err", err)
 		}
-	}
+		close(exited)
+	}()
 
-	if _, err := proc.Process.Wait(); err != nil {
-		log.Println("[PROC] Chat program terminated with error")
+	outputDone := make(chan struct{})
+	diagDone := make(chan struct{})
+	go stdoutToOutput(log, outr, outputIO, errIO, outputDone)
+	go stderrToDiag(log, errr, diagIO, diagDone)
+	inputToStdin(log, inw, inputIO, errIO, quit, exited)
+
+	select {
+	case <-exited:
+	default:
+		timeout := time.After(killWait)
+		if err := proc.Process.Signal(os.Interrupt); err != nil {
+			log.Warn("Cannot interrupt chat program", "err", err)
+			timeout = time.After(0)
+		}
+		select {
+		case <-exited:
+		case <-timeout:
+			log.Warn("Chat program did not exit, killing it")
+			if err := proc.Process.Kill(); err != nil {
+				log.Error("Cannot kill chat program", "err", err)
+			}
+			<-exited
+		}
 	}
+	<-outputDone
+	<-diagDone
 
-	log.Println("[PROC] Done")
+	status := ExitStatus{
+		Started: true,
+		Code:    -1,
+		Reason:  "unknown exit status",
+		Uptime:  time.Since(startTime),
+	}
+	if state != nil {
+		status.Code = state.ExitCode()
+		status.Reason = state.String()
+	}
+	log.Info("Chat program exited", "status", status.Reason, "uptime", status.Uptime)
+	return status
 }
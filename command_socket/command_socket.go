@@ -1,11 +1,16 @@
 package command_socket
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,11 +18,14 @@ const (
 	// Maximum allowed wait time for writes to the client
 	writeWait = 10 * time.Second
 
-	// Maximum allowed wait time for reads from the client
-	readWait = 60 * time.Second
-
 	// Time to wait before forcibly disconnecting clients
 	closeGracePeriod = 10 * time.Second
+)
+
+// Keepalive timing, shortened by the tests
+var (
+	// Maximum allowed wait time for reads from the client
+	readWait = 60 * time.Second
 
 	// Period after which the pong read is timed-out
 	pongWait = readWait
@@ -29,47 +37,168 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{JSON_PROTOCOL},
 }
 
-func sockToStdin(ws *websocket.Conn, inputIO chan<- []byte, errIO chan<- Error) {
+func sockToStdin(ws *websocket.Conn, h *Hub, c *client) {
 	ws.SetReadDeadline(time.Now().Add(readWait))
 	for {
-		log.Println("[SOCKET] Waiting")
 		_, msg, err := ws.ReadMessage()
-		log.Println("[SOCKET] -> [inputIO]", string(msg))
 		if err != nil {
-			errIO <- Error{err: err, msg: "Could not read from socket"}
-			log.Println("[inputIO] Closing")
-			close(inputIO)
+			c.log.Info("Socket closed", "reason", err)
+			return
+		}
+
+		id := ""
+		if c.json {
+			// Start from the current parameters so that a tune frame only
+			// needs to list the ones it changes
+			params := c.radio.params
+			f := Frame{Params: &params}
+			if err := json.Unmarshal(msg, &f); err != nil {
+				c.log.Warn("Invalid frame received", "err", err)
+				c.radio.unicast(c, newFrame(FRAME_ERROR, "Invalid frame"))
+				continue
+			}
+			switch {
+			case f.Type == FRAME_TUNE && f.Params != nil:
+				h.tune(c, f.ID, *f.Params)
+				continue
+			case f.Type != FRAME_MESSAGE:
+				c.log.Warn("Unexpected frame received", "type", f.Type)
+				c.radio.unicast(c, newFrame(FRAME_ERROR, "Invalid frame"))
+				continue
+			}
+			id = f.ID
+			msg = f.inputLine()
+		} else if strings.HasPrefix(string(msg), TUNE_COMMAND) {
+			q, err := url.ParseQuery(strings.TrimPrefix(string(msg), TUNE_COMMAND))
+			if err != nil {
+				c.radio.unicast(c, errorFrame(Error{err: err, msg: "Invalid tune command"}))
+				continue
+			}
+			params, err := c.radio.params.withQuery(q)
+			if err != nil {
+				c.radio.unicast(c, errorFrame(Error{err: err, msg: err.Error()}))
+				continue
+			}
+			h.tune(c, "", params)
+			continue
+		}
+
+		c.log.Debug("Message received", "body", string(msg))
+		if id == "" {
+			id = newFrameID()
+		}
+		o, err := c.radio.queueMessage(c, id, msg)
+		if err == TOO_LONG {
+			c.log.Info("Message too long, discarded", "size", len(msg))
+			f := errorFrame(Error{err: err, msg: fmt.Sprintf(
+				"Message is too long, the limit is %d characters", MAX_FRAGMENTED_LENGTH)})
+			f.ID = id
+			c.radio.unicast(c, f)
+			continue
+		}
+		if err != nil {
+			c.log.Info("Radio is gone, message discarded")
 			return
 		}
-		inputIO <- msg
+
+		// Keep reading while the message waits in the transmit queue, which
+		// can take longer than the pong wait
+		c.outgoing.Add(1)
+		go func(r *Radio) {
+			defer c.outgoing.Done()
+			awaitSent(r, c, o)
+		}(c.radio)
+	}
+}
+
+// awaitSent waits until a message queued by the client is written to the
+// chat program, and tells the client.
+func awaitSent(r *Radio, c *client, o *outgoing) {
+	e, err := r.awaitMessage(o, c.kicked.Done())
+	if err != nil {
+		if c.kicked.Err() == nil {
+			c.log.Info("Radio is gone, message discarded")
+			f := errorFrame(Error{err: err, msg: "Message was not sent, the radio is not available"})
+			f.ID = o.id
+			r.unicast(c, f)
+		}
+		return
+	}
+	if c.json {
+		r.unicast(c, ackFrame(o.id, e))
+	}
+}
+
+func writeFrame(ws *websocket.Conn, c *client, f Frame) (err error) {
+	if !c.json && f.text == "" {
+		return nil
+	}
+	start := time.Now()
+	if c.json {
+		err = ws.WriteJSON(f)
+	} else {
+		err = ws.WriteMessage(websocket.TextMessage, []byte(f.text))
 	}
+	observeWrite(start, err)
+	return err
 }
 
-func stdoutToSock(ws *websocket.Conn, outputIO <-chan []byte, errIO chan<- Error) {
+// stdoutToSock sends the client's frames until the session ends or the
+// client is kicked. It closes the socket when it returns, which also ends
+// the reader.
+func stdoutToSock(ctx context.Context, ws *websocket.Conn, c *client) {
+	defer ws.Close()
+
+	for _, f := range c.backlog {
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := writeFrame(ws, c, f); err != nil {
+			c.log.Warn("Could not write to socket", "err", err)
+			return
+		}
+	}
+	c.backlog = nil
+
 	for {
-		log.Println("[outputIO] Waiting")
-		msg, more := <-outputIO
-		if more {
-			ws.SetWriteDeadline(time.Now().Add(writeWait))
-			log.Println("[SOCKET] <- [outputIO]", string(msg))
-			if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
-				log.Println("[SOCKET] <- [outputIO] GARBLED!")
-				if err := ws.WriteMessage(websocket.TextMessage,
-					[]byte("Last message was garbled")); err != nil {
-					errIO <- Error{err: err, msg: "Could not write to socket"}
-				}
+		var f Frame
+		select {
+		case f = <-c.send:
+		case <-c.kicked.Done():
+			if ctx.Err() != nil {
+				// The reader is done, so the peer is gone or has closed
 				return
 			}
-		} else {
-			log.Println("[outputIO] Done")
+
+			// Flush what is queued and start the close handshake. The reader
+			// ends the session as soon as the peer answers.
+			c.log.Debug("Closing socket", "code", c.closeCode)
+			for len(c.send) > 0 {
+				ws.SetWriteDeadline(time.Now().Add(writeWait))
+				writeFrame(ws, c, <-c.send)
+			}
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, ""))
+			select {
+			case <-ctx.Done():
+			case <-time.After(closeGracePeriod):
+				c.log.Info("Client did not answer the close handshake")
+			}
+			return
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		c.log.Debug("Sending frame", "type", f.Type, "body", f.Body)
+		if err := writeFrame(ws, c, f); err != nil {
+			c.log.Warn("Could not write to socket", "err", err)
 			return
 		}
 	}
 }
 
-func ping(ws *websocket.Conn, errIO chan Error, done chan struct{}) {
+// ping keeps the connection alive until the session ends. It closes the
+// socket when a ping cannot be sent.
+func ping(ctx context.Context, log *slog.Logger, ws *websocket.Conn) {
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
@@ -78,84 +207,170 @@ func ping(ws *websocket.Conn, errIO chan Error, done chan struct{}) {
 	for {
 		select {
 		case <-ticker.C:
-			log.Println("[SOCKET] <- ping")
+			log.Debug("Sending ping")
 			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				errIO <- Error{err: err, msg: "Could not send ping"}
+				log.Warn("Could not send ping", "err", err)
+				metrics.pingFailures.inc()
+				ws.Close()
 				return
 			}
-		case <-done:
-			log.Println("[SOCKET] Terminating ping")
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func logErrors(ws *websocket.Conn, errIO <-chan Error) {
-	for {
-		err := <-errIO
-		log.Println("[ERROR]", err.msg, err.err.Error())
-		ws.WriteMessage(websocket.TextMessage, []byte(err.msg))
+func parseIntParam(q url.Values, param string, def int) (int, error) {
+	val := q.Get(param)
+	if val == "" {
+		return def, nil
 	}
+	return strconv.Atoi(val)
 }
 
-func parseIntParam(q url.Values, param string, def int) int {
+func parseSeqParam(q url.Values, param string) (uint64, error) {
 	val := q.Get(param)
-	i, err := strconv.Atoi(val)
-	if err != nil {
-		return def
+	if val == "" {
+		return 0, nil
 	}
-	return i
+	return strconv.ParseUint(val, 10, 64)
 }
 
-func parseFloatParam(q url.Values, param string, def float64) float64 {
+func parseFloatParam(q url.Values, param string, def float64) (float64, error) {
 	val := q.Get(param)
-	n, err := strconv.ParseFloat(val, -1)
+	if val == "" {
+		return def, nil
+	}
+	return strconv.ParseFloat(val, 64)
+}
+
+// parseReplay reads the since and history query parameters. With since, the
+// client gets everything after that sequence number. Otherwise it gets the
+// last history entries, HistoryReplay by default.
+func (h *Hub) parseReplay(q url.Values) (*replay, error) {
+	var errs ValidationError
+	since, err := parseSeqParam(q, "since")
 	if err != nil {
-		return def
+		errs = append(errs, FieldError{"since", q.Get("since"), "must be a sequence number"})
+	}
+	limit, err := parseIntParam(q, "history", h.HistoryReplay)
+	if err != nil || limit < 0 {
+		errs = append(errs, FieldError{"history", q.Get("history"), "must be a positive number"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if limit == 0 && q.Get("history") != "" {
+		return nil, nil
+	}
+	if q.Get("since") != "" {
+		if q.Get("history") == "" {
+			limit = 0
+		}
+		return &replay{since: since, limit: limit}, nil
+	}
+	if limit == 0 {
+		return nil, nil
 	}
-	return n
+	return &replay{limit: limit}, nil
 }
 
-func ServeSock(w http.ResponseWriter, r *http.Request, cmd string) {
-	log.Println("Starting new connection")
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Hub) ServeSock(w http.ResponseWriter, r *http.Request) {
+	log := newSessionLogger().With("remote", r.RemoteAddr)
+	log.Info("Starting new connection")
+	if !h.Access.authorize(w, r, false) {
+		return
+	}
 
 	// Parse out the radio configuration
 	q := r.URL.Query()
-	params := RadioParams{
-		frequency:       parseFloatParam(q, "frequency", DEFAULT_FREQUENCY),
-		bandwidth:       parseIntParam(q, "bandwidth", DEFAULT_BANDWIDTH),
-		spreadingFactor: parseIntParam(q, "spreadingFactor", DEFAULT_SPREADING_FACTOR),
-		codingRate:      parseIntParam(q, "codingRate", DEFAULT_CODING_RATE),
+	params, err := defaultRadioParams.withQuery(q)
+	if err != nil {
+		log.Info("Rejected connection", "err", err)
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid radio parameters",
+			"fields": err,
+		})
+		return
+	}
+
+	// Work out which part of the history to replay
+	rp, err := h.parseReplay(q)
+	if err != nil {
+		log.Info("Rejected connection", "err", err)
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid history parameters",
+			"fields": err,
+		})
+		return
+	}
+
+	// Diagnostics of the chat program are only sent on request
+	diagnostics := false
+	if v := q.Get("diagnostics"); v != "" {
+		if diagnostics, err = strconv.ParseBool(v); err != nil {
+			log.Info("Rejected connection", "err", err)
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid diagnostics parameter",
+				"fields": ValidationError{{"diagnostics", v, "must be true or false"}},
+			})
+			return
+		}
 	}
 
 	// Upgrade HTTP connection to websocket
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("upgrade:", err)
+		log.Info("Could not upgrade connection", "err", err)
 		return
 	}
 
-	// Create channels for communicating with the underlying chat program
-	inputIO := make(chan []byte)  // socket -> chat
-	outputIO := make(chan []byte) // chat -> socket
-	errIO := make(chan Error)
-	done := make(chan struct{})
+	// Attach to the chat program for this configuration, starting it if
+	// this is the first client
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	c := newClient(ctx, ws.Subprotocol() == JSON_PROTOCOL, log)
+	c.diagnostics = diagnostics
+	c.radio = h.attach(params, c, rp)
+	if c.radio == nil {
+		log.Info("Server is shutting down, connection refused")
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"),
+			time.Now().Add(writeWait))
+		ws.Close()
+		return
+	}
 
-	// Spin up all goroutines
-	go SpawnChat(cmd, params, done, inputIO, outputIO, errIO)
-	go sockToStdin(ws, inputIO, errIO)
-	go stdoutToSock(ws, outputIO, errIO)
-	go logErrors(ws, errIO)
-	go ping(ws, errIO, done)
+	metrics.sessions.add(1)
+	defer metrics.sessions.add(-1)
 
-	// Block the done channel and wait for something to send to it
-	<-done
+	// The reader runs in this goroutine, and the session ends when it
+	// returns. The writer and the pinger close the socket when they fail,
+	// which makes the reader return.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stdoutToSock(ctx, ws, c)
+	}()
+	go func() {
+		defer wg.Done()
+		ping(ctx, log, ws)
+	}()
 
-	// Clean up
-	log.Println("[SOCKET] Closing")
-	ws.SetWriteDeadline(time.Now().Add(writeWait))
-	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	time.Sleep(closeGracePeriod)
+	sockToStdin(ws, h, c)
+	cancel()
+	c.outgoing.Wait()
+	h.detach(c.radio, c)
 	ws.Close()
-	log.Println("[SOCKET] Closed")
+	wg.Wait()
+	h.sessions.Done()
+	log.Info("Connection closed")
 }
@@ -0,0 +1,1697 @@
+package command_socket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Environment variable that makes the test binary act as the chat program
+const fakeChatEnv = "WSCHAT_FAKE_CHAT"
+
+// How long to wait for something to happen before failing a test
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(fakeChatEnv) {
+	case "":
+	case "simulator":
+		os.Exit(RunSimulator(os.Args[2:], os.Stdin, os.Stdout, os.Stderr, nil))
+	default:
+		os.Exit(fakeChat())
+	}
+
+	pingInterval = 100 * time.Millisecond
+	pongWait = 2 * time.Second
+	readWait = pongWait
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Frequency at which the fake chat program fails to start, when the tests
+// pass the frequency as its argument
+const failFrequency = "433"
+
+// fakeChat is the chat program used by the tests, unless they ask for a
+// simulated radio. It prints every line it
+// reads, except for these commands:
+//
+//	!crash     exit with status 3
+//	!garble    print a line that is not valid UTF-8
+//	!diag      print a line to standard error
+func fakeChat() int {
+	if len(os.Args) > 1 && os.Args[1] == failFrequency {
+		return 3
+	}
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		switch line := s.Text(); line {
+		case "!crash":
+			return 3
+		case "!garble":
+			os.Stdout.Write([]byte{0xff, 0xfe, '\n'})
+		case "!diag":
+			fmt.Fprintln(os.Stderr, "fake chat: all good")
+		default:
+			fmt.Println(line)
+		}
+	}
+	return 0
+}
+
+// newTestServer starts a hub that runs the fake chat program, behind a test
+// HTTP server. When the test ends, the hub is shut down and the test fails
+// if goroutines are left behind.
+func newTestServer(t *testing.T) (*Hub, *httptest.Server) {
+	baseline := runtime.NumGoroutine()
+	h := NewHub(os.Args[0])
+	h.Command = Command{Path: os.Args[0], Env: []string{fakeChatEnv + "=1"}}
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeSock))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			t.Error("hub did not shut down:", err)
+		}
+		srv.Close()
+		expectNoLeaks(t, baseline)
+	})
+	return h, srv
+}
+
+// newSimulatedStations starts a test server for each callsign, whose chat
+// programs are simulated radios sharing the same ether.
+func newSimulatedStations(t *testing.T, callsigns ...string) ([]*Hub, []*httptest.Server) {
+	ether := t.TempDir()
+	var hubs []*Hub
+	var srvs []*httptest.Server
+	for _, callsign := range callsigns {
+		h, srv := newTestServer(t)
+		h.Command = SimulatorCommand(os.Args[0], SimulatorOptions{Ether: ether})
+		h.Command.Env = []string{fakeChatEnv + "=simulator"}
+		h.Callsign = callsign
+		hubs = append(hubs, h)
+		srvs = append(srvs, srv)
+	}
+	return hubs, srvs
+}
+
+// expectNoLeaks waits for the number of goroutines to go back to the
+// baseline, and fails the test with their stacks if it does not.
+func expectNoLeaks(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-baseline, buf)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testClient struct {
+	t        *testing.T
+	ws       *websocket.Conn
+	messages chan string
+}
+
+// dial connects to the test server and reads the messages in the
+// background, which also answers the pings.
+func dial(t *testing.T, srv *httptest.Server, query string, json bool) *testClient {
+	t.Helper()
+	d := websocket.Dialer{}
+	if json {
+		d.Subprotocols = []string{JSON_PROTOCOL}
+	}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sock?"+query, nil)
+	if err != nil {
+		t.Fatal("cannot connect:", err)
+	}
+	c := &testClient{t: t, ws: ws, messages: make(chan string, 100)}
+	go func() {
+		defer close(c.messages)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.messages <- string(msg)
+		}
+	}()
+	t.Cleanup(func() { ws.Close() })
+	return c
+}
+
+func (c *testClient) send(msg string) {
+	c.t.Helper()
+	if err := c.ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		c.t.Fatal("cannot send:", err)
+	}
+}
+
+// expect waits for messages containing each of the given strings, in any
+// order, skipping other messages.
+func (c *testClient) expect(wants ...string) {
+	c.t.Helper()
+	missing := append([]string(nil), wants...)
+	timeout := time.After(testTimeout)
+	for len(missing) > 0 {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for %q", missing)
+			}
+			for i, want := range missing {
+				if strings.Contains(msg, want) {
+					missing = append(missing[:i], missing[i+1:]...)
+					break
+				}
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q", missing)
+		}
+	}
+}
+
+// expectClosed waits for the server to close the connection.
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatal("connection was not closed")
+		}
+	}
+}
+
+// radio returns the radio running with the parameters in the query.
+func radio(t *testing.T, h *Hub, query string) *Radio {
+	t.Helper()
+	q, _ := url.ParseQuery(query)
+	params, err := defaultRadioParams.withQuery(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.radios[params]
+	if r == nil {
+		t.Fatal("no radio running for", params)
+	}
+	return r
+}
+
+// expectStopped waits for the radio's chat program to be reaped and the
+// radio to be removed from the hub.
+func expectStopped(t *testing.T, h *Hub, r *Radio) {
+	t.Helper()
+	select {
+	case <-r.done:
+	case <-time.After(testTimeout):
+		t.Fatal("radio was not stopped")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.radios[r.params] == r {
+		t.Error("stopped radio is still registered")
+	}
+}
+
+func TestChat(t *testing.T) {
+	_, srv := newTestServer(t)
+	a := dial(t, srv, "frequency=868", false)
+	a.expect("radio started")
+	b := dial(t, srv, "frequency=868", false)
+	b.expect("joined running radio")
+	c := dial(t, srv, "frequency=868", true)
+	c.expect("joined running radio")
+
+	a.send("[A]: hello")
+	a.expect("[A]: hello")
+	b.expect("[A]: hello")
+	c.expect(`"callsign":"A"`)
+
+	c.send(`{"type": "message", "id": "m1", "callsign": "C", "body": "hi"}`)
+	c.expect(`"type":"ack","id":"m1"`, `"body":"hi"`)
+	a.expect("[C]: hi")
+}
+
+func TestSeparateRadios(t *testing.T) {
+	_, srv := newTestServer(t)
+	a := dial(t, srv, "frequency=868", false)
+	a.expect("radio started")
+	b := dial(t, srv, "frequency=915", false)
+	b.expect("radio started")
+
+	a.send("[A]: on 868")
+	b.send("[B]: on 915")
+	a.expect("[A]: on 868")
+	b.expect("[B]: on 915")
+	select {
+	case msg := <-a.messages:
+		t.Errorf("client on another radio received %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	_, srv := newTestServer(t)
+	for _, query := range []string{
+		"frequency=NaN", "frequency=Inf", "frequency=-Inf", "frequency=1", "frequency=abc",
+		"bandwidth=300", "spreadingFactor=13", "codingRate=4",
+	} {
+		resp, err := http.Get(srv.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestProcessCrash(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.MaxRestarts = 1
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+
+	a.send("!crash")
+	a.expect("radio exited (exit status 3)", "radio restarting (attempt 1/1)")
+	a.send("[A]: back")
+	a.expect("[A]: back")
+
+	a.send("!crash")
+	a.expect("radio stopped after too many restarts")
+	a.expectClosed()
+}
+
+func TestGarbledOutput(t *testing.T) {
+	_, srv := newTestServer(t)
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+
+	before := metrics.garbled.value()
+	a.send("!garble")
+	a.expect("Last message was garbled")
+	if metrics.garbled.value() == before {
+		t.Error("garbled line was not counted")
+	}
+	a.send("[A]: still here")
+	a.expect("[A]: still here")
+}
+
+func TestClientDisconnect(t *testing.T) {
+	h, srv := newTestServer(t)
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+	r := radio(t, h, "")
+
+	a.ws.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	a.expectClosed()
+	expectStopped(t, h, r)
+}
+
+func TestClientVanishes(t *testing.T) {
+	h, srv := newTestServer(t)
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+	r := radio(t, h, "")
+
+	a.ws.Close()
+	expectStopped(t, h, r)
+}
+
+func TestPingTimeout(t *testing.T) {
+	h, srv := newTestServer(t)
+
+	// Without reading, the client never answers the pings
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sock", nil)
+	if err != nil {
+		t.Fatal("cannot connect:", err)
+	}
+	defer ws.Close()
+
+	var r *Radio
+	for deadline := time.Now().Add(testTimeout); r == nil; {
+		h.mu.Lock()
+		r = h.radios[defaultRadioParams]
+		h.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("radio was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectStopped(t, h, r)
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	_, srv := newTestServer(t)
+	queries := []string{"frequency=868", "frequency=915", "frequency=2400"}
+	const perRadio = 4
+
+	var clients []*testClient
+	for _, q := range queries {
+		for i := 0; i < perRadio; i++ {
+			clients = append(clients, dial(t, srv, q, false))
+		}
+	}
+	for _, c := range clients {
+		c.expect("radio")
+	}
+
+	errs := make(chan error, len(clients))
+	for i, c := range clients {
+		go func(i int, c *testClient) {
+			errs <- c.ws.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("[c%d]: hello", i)))
+		}(i, c)
+	}
+	for range clients {
+		if err := <-errs; err != nil {
+			t.Fatal("cannot send:", err)
+		}
+	}
+
+	for i, c := range clients {
+		group := i / perRadio
+		var wants []string
+		for j := group * perRadio; j < (group+1)*perRadio; j++ {
+			wants = append(wants, fmt.Sprintf("[c%d]: hello", j))
+		}
+		c.expect(wants...)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	hubs, srvs := newSimulatedStations(t, "A", "B")
+	for _, h := range hubs {
+		h.Acks = true
+	}
+	a := dial(t, srvs[0], "spreadingFactor=7", true)
+	a.expect("radio started")
+	b := dial(t, srvs[1], "spreadingFactor=7", true)
+	b.expect("radio started")
+
+	a.send(`{"type": "message", "id": "m1", "callsign": "A", "body": "hi"}`)
+	a.expect(`"body":"transmitted"`)
+	b.expect(`"callsign":"A","body":"hi"`)
+	a.expect(`"callsign":"B","body":"acked"`)
+}
+
+func TestAckTimeout(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.Acks = true
+	h.AckTimeout = 200 * time.Millisecond
+	h.Retransmits = 1
+	a := dial(t, srv, "", true)
+	a.expect("radio started")
+
+	// The fake chat program echoes the message, which is not an
+	// acknowledgement
+	a.send(`{"type": "message", "id": "m1", "callsign": "A", "body": "hi"}`)
+	a.expect(`"body":"transmitted","attempt":2`)
+	a.expect(`"body":"timed out","attempt":2`)
+}
+
+func TestDedup(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.Dedup = DedupConfig{Mode: DEDUP_COUNT, Window: time.Minute}
+	params, d, err := ParseDedupRule("frequency=915&dedup=drop", h.Dedup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DedupRadios = map[RadioParams]DedupConfig{params: d}
+
+	a := dial(t, srv, "", true)
+	a.expect("radio started")
+	a.send(`{"type": "message", "callsign": "A", "body": "hi"}`)
+	a.send(`{"type": "message", "callsign": "A", "body": "hi"}`)
+	a.expect(`"type":"repeat"`)
+	a.send(`{"type": "message", "callsign": "B", "body": "hi"}`)
+	a.expect(`"callsign":"B","body":"hi"`)
+
+	b := dial(t, srv, "frequency=915", false)
+	b.expect("radio started")
+	for _, msg := range []string{"[A]: hi", "[A]: hi", "[A]: bye"} {
+		b.send(msg)
+	}
+	b.expect("[A]: hi")
+	if msg := <-b.messages; msg != "[A]: bye" {
+		t.Errorf("expected the copy to be dropped, got %q", msg)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.RateLimit = 60
+	h.RateBurst = 1
+	a := dial(t, srv, "", true)
+	a.expect("radio started")
+
+	a.send(`{"type": "message", "id": "a1", "callsign": "A", "body": "one"}`)
+	a.send(`{"type": "message", "id": "a2", "callsign": "A", "body": "two"}`)
+	a.expect(`"id":"a2"`, `"body":"queued"`)
+	b := dial(t, srv, "", true)
+	b.send(`{"type": "message", "id": "b1", "callsign": "B", "body": "three"}`)
+
+	// B is not held back by A's rate limit
+	var order []string
+	for len(order) < 3 {
+		select {
+		case msg := <-a.messages:
+			if strings.Contains(msg, `"type":"message"`) {
+				order = append(order, msg)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for the messages, got", order)
+		}
+	}
+	for i, want := range []string{`"body":"one"`, `"body":"three"`, `"body":"two"`} {
+		if !strings.Contains(order[i], want) {
+			t.Errorf("message %d is %s, expected %s", i, order[i], want)
+		}
+	}
+}
+
+func TestAwaitTakenJob(t *testing.T) {
+	r := newRadio(NewHub(os.Args[0]), defaultRadioParams)
+	cancelled := make(chan struct{})
+	close(cancelled)
+
+	// A job still in the queue is cancelled
+	j, err := r.enqueue([]byte("[A]: queued"), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.await(j, cancelled); err != UNAVAILABLE {
+		t.Errorf("expected the queued job to be cancelled, got %v", err)
+	}
+	if job, _ := r.tx.next(time.Now()); job != nil {
+		t.Error("cancelled job is still queued")
+	}
+
+	// A job the scheduler has taken is waited for
+	j, _ = r.enqueue([]byte("[A]: taken"), true, nil)
+	if job, _ := r.tx.next(time.Now()); job != j {
+		t.Fatal("scheduler did not get the job")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		j.done <- nil
+	}()
+	if err := r.await(j, cancelled); err != nil {
+		t.Errorf("expected the taken job to be written, got %v", err)
+	}
+
+	// Jobs left when the radio stops fail
+	j, _ = r.enqueue([]byte("[A]: cleared"), true, nil)
+	r.tx.clear()
+	if err := r.await(j, cancelled); err != UNAVAILABLE {
+		t.Errorf("expected the cleared job to fail, got %v", err)
+	}
+}
+
+func TestLongQueueWait(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.RateLimit = 40
+	h.RateBurst = 1
+	a := dial(t, srv, "", true)
+	a.expect("radio started")
+
+	// The last message waits twice the pong wait, while the client keeps
+	// several messages in the queue
+	a.send(`{"type": "message", "id": "a1", "callsign": "A", "body": "one"}`)
+	a.send(`{"type": "message", "id": "a2", "callsign": "A", "body": "two"}`)
+	a.send(`{"type": "message", "id": "a3", "callsign": "A", "body": "three"}`)
+	a.expect(`"queue":1,"eta"`)
+	a.expect(`"callsign":"A","body":"three"`, `"type":"ack","id":"a3"`)
+}
+
+func TestDiagnostics(t *testing.T) {
+	_, srv := newTestServer(t)
+	a := dial(t, srv, "diagnostics=true", true)
+	a.expect("radio started")
+	b := dial(t, srv, "", false)
+	b.expect("joined running radio")
+
+	b.send("!diag")
+	a.expect(`"body":"fake chat: all good"`)
+	b.send("[B]: after")
+	if msg := <-b.messages; msg != "[B]: after" {
+		t.Errorf("client that did not ask for diagnostics received %q", msg)
+	}
+}
+
+func TestSimulatorErrors(t *testing.T) {
+	ether := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(ether, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"--bogus"}, 2, "flag provided but not defined"},
+		{[]string{"--sf", "13"}, 2, "spreadingFactor"},
+		{[]string{"--ether", ether}, 1, "Cannot join the simulated ether"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := RunSimulator(tt.args, strings.NewReader(""), &stdout, &stderr, nil)
+		if code != tt.code || stdout.Len() != 0 || !strings.Contains(stderr.String(), tt.want) {
+			t.Errorf("%v: exit code %d, stdout %q, stderr %q", tt.args, code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestSimulatorCorrupt(t *testing.T) {
+	// Both servers are started before any radio, so that neither counts the
+	// goroutines of the other as leaked
+	ether := t.TempDir()
+	var srvs []*httptest.Server
+	for _, corrupt := range []float64{0, 1} {
+		h, srv := newTestServer(t)
+		h.Command = SimulatorCommand(os.Args[0], SimulatorOptions{Ether: ether, Corrupt: corrupt})
+		h.Command.Env = []string{fakeChatEnv + "=simulator"}
+		srvs = append(srvs, srv)
+	}
+	var clients []*testClient
+	for _, srv := range srvs {
+		c := dial(t, srv, "", false)
+		c.expect("radio started")
+		clients = append(clients, c)
+	}
+
+	// Every packet the second radio receives is garbled, on a single line
+	for i := 0; i < 3; i++ {
+		clients[0].send("[A]: hello")
+		clients[1].expect("Last message was garbled")
+	}
+}
+
+func TestParsers(t *testing.T) {
+	h, srv := newTestServer(t)
+	custom, err := ParseParserRule(`message:^<(?P<callsign>\w+)> (?P<text>.*)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Parser = ParserChain{custom, OthernetParser{}}
+	a := dial(t, srv, "", true)
+	a.expect("radio started")
+
+	for _, line := range []string{">", "RX: rssi=-87 snr=7.5", "[A]: hi", "<C> hello", "booting"} {
+		a.send(fmt.Sprintf(`{"type": "message", "body": %q}`, line))
+	}
+	a.expect(
+		`"direction":"in","rx":{"rssi":-87,"snr":7.5}`,
+		`"callsign":"C","body":"hello"`,
+		`"body":"booting"`,
+	)
+}
+
+func TestLinkStats(t *testing.T) {
+	h, srv := newTestServer(t)
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+
+	for _, line := range []string{
+		"RX: rssi=-90 snr=5 crc=ok", "[B]: one",
+		"RSSI: -80 dBm, SNR: 9 dB, ferr: -1200 Hz, CRC: error", "[B]: two",
+		"[C]: no metadata",
+	} {
+		a.send(line)
+	}
+	a.expect("[B]: one", "[B]: two", "[C]: no metadata")
+
+	w := httptest.NewRecorder()
+	h.ServeLinks(w, httptest.NewRequest("GET", "/api/links", nil))
+	var resp struct{ Links []LinkStats }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Links) != 2 {
+		t.Fatalf("expected stats for 2 stations, got %+v", resp.Links)
+	}
+	b := resp.Links[0]
+	if b.Callsign != "B" || b.Messages != 2 || b.CRCErrors != 1 {
+		t.Errorf("unexpected stats for B: %+v", b)
+	}
+	if b.RSSI == nil || b.RSSI.Mean != -85 || b.RSSI.Last != -80 || b.RSSI.Min != -90 {
+		t.Errorf("unexpected RSSI for B: %+v", b.RSSI)
+	}
+	if b.FreqError == nil || b.FreqError.Max != -1200 {
+		t.Errorf("unexpected frequency error for B: %+v", b.FreqError)
+	}
+	if c := resp.Links[1]; c.Callsign != "C" || c.Messages != 1 || c.RSSI != nil {
+		t.Errorf("unexpected stats for C: %+v", c)
+	}
+}
+
+func TestRangeTest(t *testing.T) {
+	hubs, srvs := newSimulatedStations(t, "A", "B")
+	start := func(h *Hub, body string) {
+		w := httptest.NewRecorder()
+		h.ServeRangeTest(w, httptest.NewRequest("POST", "/api/rangetest?spreadingFactor=7", strings.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+	}
+	a := dial(t, srvs[0], "spreadingFactor=7", true)
+	a.expect("radio started")
+	start(hubs[1], `{"mode": "respond"}`)
+	start(hubs[0], `{"interval": "200ms", "count": 3, "timeout": "5s"}`)
+	a.expect(`"body":"answered"`, `"body":"answered"`, `"body":"answered"`)
+	a.expect(`"body":"finished"`)
+
+	w := httptest.NewRecorder()
+	hubs[0].ServeRangeTest(w, httptest.NewRequest("GET", "/api/rangetest?spreadingFactor=7", nil))
+	var report struct {
+		Stats    RangeTestStats
+		Finished *time.Time
+		Probes   []ProbeResult
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if s := report.Stats; s.Sent != 3 || s.Answered != 3 || s.Loss != 0 || s.RTT == nil || report.Finished == nil {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if p := report.Probes[0]; p.Responder != "B" {
+		t.Errorf("expected B to answer, got %+v", p)
+	}
+
+	w = httptest.NewRecorder()
+	hubs[0].ServeRangeTest(w, httptest.NewRequest("GET", "/api/rangetest?spreadingFactor=7&format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "seq,sent,state") || !strings.Contains(lines[3], ",answered,B,") {
+		t.Errorf("unexpected CSV: %q", lines)
+	}
+
+	w = httptest.NewRecorder()
+	hubs[1].ServeRangeTest(w, httptest.NewRequest("DELETE", "/api/rangetest?spreadingFactor=7", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 when stopping the responder, got %d", w.Code)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	hubs, _ := newSimulatedStations(t, "A", "B")
+	start := time.Now().Add(2 * time.Second).Format(time.RFC3339)
+	plan := `"start": "` + start + `", "step": "1s", "guard": "300ms", "probes": 2, "interval": "100ms", "timeout": "500ms",
+		"bandwidths": [800], "spreadingFactors": [8, 7], "codingRates": [5]`
+	for i, mode := range []string{"probe", "respond"} {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"mode": "` + mode + `", ` + plan + `}`)
+		hubs[i].ServeSweep(w, httptest.NewRequest("POST", "/api/sweep", body))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	report := func(h *Hub) SweepReport {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			w := httptest.NewRecorder()
+			h.ServeSweep(w, httptest.NewRequest("GET", "/api/sweep", nil))
+			var report struct {
+				Finished *time.Time
+				Ranking  []SweepStep
+			}
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Finished != nil {
+				return SweepReport{Finished: report.Finished, Ranking: report.Ranking}
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("sweep did not finish")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	for i, h := range hubs {
+		r := report(h)
+		if len(r.Ranking) != 2 {
+			t.Fatalf("expected 2 ranked steps, got %+v", r.Ranking)
+		}
+		best := r.Ranking[0]
+		if best.DeliveryRatio != 1 || best.Params.spreadingFactor != 7 || best.TimeOnAir >= r.Ranking[1].TimeOnAir {
+			t.Errorf("unexpected ranking on station %d: %+v", i, r.Ranking)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	hubs[0].ServeSweep(w, httptest.NewRequest("GET", "/api/sweep?format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "1,800,7,5,1,") {
+		t.Errorf("unexpected CSV: %q", lines)
+	}
+}
+
+func TestTune(t *testing.T) {
+	h, srv := newTestServer(t)
+	a := dial(t, srv, "frequency=868", true)
+	a.expect("radio started")
+	b := dial(t, srv, "frequency=868", false)
+	b.expect("joined running radio")
+	old := radio(t, h, "frequency=868")
+
+	a.send(`{"type": "tune", "id": "t1", "params": {"frequency": 915}}`)
+	a.expect(`"type":"status","id":"t1"`)
+	a.send(`{"type": "message", "id": "m1", "callsign": "A", "body": "on 915"}`)
+	a.expect(`"type":"ack","id":"m1"`, `"body":"on 915"`)
+
+	// The old radio keeps running for the client that stayed
+	b.send("[B]: on 868")
+	b.expect("[B]: on 868")
+	select {
+	case <-old.done:
+		t.Fatal("radio stopped while a client was still using it")
+	default:
+	}
+
+	b.send("/tune frequency=915")
+	b.expect("radio tuned to 915 MHz, BW 400 kHz, SF 12, CR 4/5")
+	expectStopped(t, h, old)
+	b.send("[B]: on 915")
+	a.expect(`"callsign":"B","body":"on 915"`)
+}
+
+func TestTuneInvalidParams(t *testing.T) {
+	_, srv := newTestServer(t)
+	a := dial(t, srv, "frequency=868", true)
+	a.expect("radio started")
+	b := dial(t, srv, "frequency=868", false)
+	b.expect("joined running radio")
+
+	a.send(`{"type": "tune", "id": "t1", "params": {"spreadingFactor": 13}}`)
+	a.expect(`"type":"error","id":"t1"`)
+	a.send(`{"type": "tune", "id": "t2", "params": {"frequency": "868"}}`)
+	a.expect(`"body":"Invalid frame"`)
+	b.send("/tune bandwidth=300")
+	b.expect("invalid parameters: bandwidth")
+	b.send("/tune frequency=abc")
+	b.expect("invalid parameters: frequency must be a number")
+	b.send("/tune frequency=%zz")
+	b.expect("Invalid tune command")
+
+	// Both clients are still on the original radio
+	a.send(`{"type": "message", "id": "m1", "callsign": "A", "body": "still here"}`)
+	a.expect(`"type":"ack","id":"m1"`)
+	b.expect("[A]: still here")
+}
+
+func TestTuneRollback(t *testing.T) {
+	h, srv := newTestServer(t)
+	h.Command.Args = []string{"{frequency}"}
+	a := dial(t, srv, "frequency=868", false)
+	a.expect("radio started")
+	old := radio(t, h, "frequency=868")
+
+	a.send("/tune frequency=" + failFrequency)
+	a.expect("Could not retune radio (exit status 3)")
+	expectStopped(t, h, old)
+
+	// The client is back on the old frequency with a fresh chat program
+	b := dial(t, srv, "frequency=868", false)
+	b.expect("joined running radio")
+	a.send("[A]: back on 868")
+	a.expect("[A]: back on 868")
+	b.expect("[A]: back on 868")
+}
+
+func TestFragment(t *testing.T) {
+	words := strings.Repeat("lorem ipsum dolor sit amet ", 6)
+	tests := []struct {
+		name  string
+		line  string
+		parts int
+		err   error
+	}{
+		{"short", "[A]: hello", 1, nil},
+		{"longest unfragmented", "[A]: " + strings.Repeat("x", MAX_MESSAGE_LENGTH), 1, nil},
+		{"words", "[A]: " + words, 5, nil},
+		{"no callsign", words, 5, nil},
+		{"white space run", "[A]: a" + strings.Repeat(" ", 60) + "b", 2, nil},
+		{"longest fragmented", "[A]: " + strings.Repeat("x", MAX_FRAGMENTED_LENGTH), MAX_FRAGMENTS, nil},
+		{"too long", "[A]: " + strings.Repeat("x", MAX_FRAGMENTED_LENGTH+1), 0, TOO_LONG},
+	}
+	for _, tt := range tests {
+		lines, err := fragment([]byte(tt.line))
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if len(lines) != tt.parts {
+			t.Errorf("%s: expected %d parts, got %d: %q", tt.name, tt.parts, len(lines), lines)
+			continue
+		}
+		if len(lines) == 1 && string(lines[0]) != tt.line {
+			t.Errorf("%s: expected the line as is, got %q", tt.name, lines[0])
+		}
+		if len(lines) < 2 {
+			continue
+		}
+
+		prefix, _ := splitLine(tt.line)
+		ra := newReassembler()
+		for i, line := range lines {
+			if _, text := splitLine(string(line)); len([]rune(text)) > MAX_MESSAGE_LENGTH {
+				t.Errorf("%s: part %d is too long: %q", tt.name, i+1, line)
+			}
+			if !strings.HasPrefix(string(line), prefix) {
+				t.Errorf("%s: part %d lost the prefix: %q", tt.name, i+1, line)
+			}
+			whole, ok := ra.add(line)
+			if ok != (i == len(lines)-1) {
+				t.Fatalf("%s: part %d of %d completed the message: %v", tt.name, i+1, len(lines), ok)
+			}
+			if ok && string(whole) != tt.line {
+				t.Errorf("%s: reassembled %q, expected %q", tt.name, whole, tt.line)
+			}
+		}
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{"not a fragment", []string{"[A]: hello", "status"}, []string{"[A]: hello", "status"}},
+		{"in order", []string{"[A]: ~abc:1/2~hel", "[A]: ~abc:2/2~lo"}, []string{"[A]: hello"}},
+		{"out of order", []string{"[A]: ~abc:3/3~c", "[A]: ~abc:1/3~a", "[A]: ~abc:2/3~b"}, []string{"[A]: abc"}},
+		{"duplicate", []string{"[A]: ~abc:1/2~a", "[A]: ~abc:1/2~a", "[A]: ~abc:2/2~b"}, []string{"[A]: ab"}},
+		{"prompt", []string{">[A]: ~abc:1/2~hel", "[A]: ~abc:2/2~lo"}, []string{"[A]: hello"}},
+		{"no callsign", []string{">~abc:1/2~hel", "~abc:2/2~lo"}, []string{"hello"}},
+		{"callsigns", []string{"[A]: ~abc:1/2~a", "[B]: ~abc:2/2~b", "[A]: ~abc:2/2~c"}, []string{"[A]: ac"}},
+		{"bad index", []string{"[A]: ~abc:3/2~a"}, []string{"[A]: ~abc:3/2~a"}},
+	}
+	for _, tt := range tests {
+		ra := newReassembler()
+		var got []string
+		for _, line := range tt.lines {
+			if whole, ok := ra.add([]byte(line)); ok {
+				got = append(got, string(whole))
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReassembleExpire(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		line    string
+		missing []int
+	}{
+		{"middle", []string{"[A]: ~abc:2/3~mid"}, "[A]: …mid…", []int{1, 3}},
+		{"end", []string{">[A]: ~abc:1/3~a", "[A]: ~abc:2/3~b"}, "[A]: ab…", []int{3}},
+	}
+	for _, tt := range tests {
+		ra := newReassembler()
+		for _, line := range tt.lines {
+			ra.add([]byte(line))
+		}
+		if expired := ra.expire(time.Now()); len(expired) != 0 {
+			t.Errorf("%s: expired too early: %+v", tt.name, expired)
+		}
+		expired := ra.expire(time.Now().Add(fragmentTimeout))
+		if len(expired) != 1 {
+			t.Fatalf("%s: expected 1 incomplete message, got %+v", tt.name, expired)
+		}
+		m := expired[0]
+		if string(m.line) != tt.line || joinInts(m.missing) != joinInts(tt.missing) || m.total != 3 {
+			t.Errorf("%s: unexpected incomplete message %q, missing %v of %d", tt.name, m.line, m.missing, m.total)
+		}
+		if len(ra.partial) != 0 {
+			t.Errorf("%s: incomplete message was not forgotten", tt.name)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{"no origin", nil, "", true},
+		{"no origin with list", []string{"https://example.com"}, "", true},
+		{"same host", nil, "http://wschat.local:8080", true},
+		{"same host, other case", nil, "http://WSCHAT.local:8080", true},
+		{"other host", nil, "http://evil.example", false},
+		{"other port", nil, "http://wschat.local:9090", false},
+		{"malformed", nil, "http://%zz", false},
+		{"listed", []string{"https://example.com"}, "https://example.com", true},
+		{"listed, other case", []string{"https://example.com"}, "https://EXAMPLE.com", true},
+		{"not listed", []string{"https://example.com"}, "http://example.com", false},
+		{"same host, not listed", []string{"https://example.com"}, "http://wschat.local:8080", false},
+		{"any", []string{"*"}, "http://evil.example", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://wschat.local:8080/sock", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		a := &AccessControl{AllowedOrigins: tt.allowed}
+		if ok := a.checkOrigin(r); ok != tt.ok {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.ok, ok)
+		}
+	}
+	var a *AccessControl
+	r := httptest.NewRequest("GET", "http://wschat.local/sock", nil)
+	r.Header.Set("Origin", "http://evil.example")
+	if a.checkOrigin(r) {
+		t.Error("nil access control allowed another origin")
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		list []string
+		nets string
+		err  bool
+	}{
+		{nil, "", false},
+		{[]string{"192.168.1.7"}, "192.168.1.7/32", false},
+		{[]string{"10.0.0.0/8", "fd00::/8"}, "10.0.0.0/8 fd00::/8", false},
+		{[]string{"::1"}, "::1/128", false},
+		{[]string{"::ffff:10.1.2.3"}, "10.1.2.3/32", false},
+		{[]string{"10.0.0.1/24"}, "10.0.0.0/24", false},
+		{[]string{"10.0.0.0/33"}, "", true},
+		{[]string{"10.0.0.256"}, "", true},
+		{[]string{"fd00::/129"}, "", true},
+		{[]string{"localhost"}, "", true},
+		{[]string{"10.0.0.0/8", "/8"}, "", true},
+	}
+	for _, tt := range tests {
+		nets, err := ParseNetworks(tt.list)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.list, err)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if strings.Join(got, " ") != tt.nets {
+			t.Errorf("%q: expected %q, got %q", tt.list, tt.nets, got)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	networks := func(list ...string) []*net.IPNet {
+		nets, err := ParseNetworks(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nets
+	}
+	a := &AccessControl{
+		Token:    "s3cret",
+		AllowIPs: networks("192.168.1.0/24", "fd00::/8", "127.0.0.1"),
+		DenyIPs:  networks("192.168.1.66", "fd00::bad"),
+	}
+	tests := []struct {
+		name   string
+		remote string
+		origin string
+		auth   string
+		query  string
+		cookie string
+		status int
+	}{
+		{"bearer token", "192.168.1.7:5000", "", "Bearer s3cret", "", "", http.StatusOK},
+		{"query token", "192.168.1.7:5000", "", "", "?token=s3cret", "", http.StatusOK},
+		{"cookie token", "192.168.1.7:5000", "", "", "", "s3cret", http.StatusOK},
+		{"IPv6", "[fd00::7]:5000", "", "Bearer s3cret", "", "", http.StatusOK},
+		{"single address", "127.0.0.1:5000", "", "Bearer s3cret", "", "", http.StatusOK},
+		{"no token", "192.168.1.7:5000", "", "", "", "", http.StatusUnauthorized},
+		{"wrong bearer token", "192.168.1.7:5000", "", "Bearer s3cre", "", "", http.StatusUnauthorized},
+		{"not a bearer token", "192.168.1.7:5000", "", "Basic s3cret", "", "", http.StatusUnauthorized},
+		{"wrong query token", "192.168.1.7:5000", "", "", "?token=S3CRET", "", http.StatusUnauthorized},
+		{"wrong cookie token", "192.168.1.7:5000", "", "", "", "s3cret2", http.StatusUnauthorized},
+		{"wrong bearer, right cookie", "192.168.1.7:5000", "", "Bearer nope", "", "s3cret", http.StatusUnauthorized},
+		{"denied IPv4", "192.168.1.66:5000", "", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"denied IPv6", "[fd00::bad]:5000", "", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"not allowed IPv4", "10.0.0.1:5000", "", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"not allowed IPv6", "[::1]:5000", "", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"unknown address", "pipe", "", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"other origin", "192.168.1.7:5000", "http://evil.example", "Bearer s3cret", "", "", http.StatusForbidden},
+		{"same origin", "192.168.1.7:5000", "http://wschat.local", "", "", "s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://wschat.local/api/messages"+tt.query, nil)
+		r.RemoteAddr = tt.remote
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: TOKEN_COOKIE, Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		if ok := a.authorize(w, r, true); ok != (tt.status == http.StatusOK) {
+			t.Errorf("%s: expected status %d, authorize returned %v", tt.name, tt.status, ok)
+			continue
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+
+	var open *AccessControl
+	if !open.authorize(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/messages", nil), true) {
+		t.Error("nil access control rejected a request")
+	}
+}
+
+func TestProtect(t *testing.T) {
+	a := &AccessControl{Token: "s3cret", DenyIPs: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}}
+	page := a.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "chat window")
+	}))
+	tests := []struct {
+		name   string
+		url    string
+		remote string
+		tls    bool
+		status int
+		cookie bool
+	}{
+		{"no token", "http://wschat.local/", "192.168.1.7:5000", false, http.StatusOK, false},
+		{"token", "http://wschat.local/?token=s3cret", "192.168.1.7:5000", false, http.StatusOK, true},
+		{"token over TLS", "https://wschat.local/?token=s3cret", "192.168.1.7:5000", true, http.StatusOK, true},
+		{"wrong token", "http://wschat.local/?token=nope", "192.168.1.7:5000", false, http.StatusOK, false},
+		{"denied address", "http://wschat.local/?token=s3cret", "10.1.2.3:5000", false, http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = tt.remote
+		if !tt.tls {
+			r.TLS = nil
+		}
+		w := httptest.NewRecorder()
+		page.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, w.Code)
+			continue
+		}
+		cookies := w.Result().Cookies()
+		if !tt.cookie {
+			if len(cookies) != 0 {
+				t.Errorf("%s: unexpected cookies %v", tt.name, cookies)
+			}
+			continue
+		}
+		if len(cookies) != 1 {
+			t.Errorf("%s: expected a token cookie, got %v", tt.name, cookies)
+			continue
+		}
+		c := cookies[0]
+		if c.Name != TOKEN_COOKIE || c.Value != "s3cret" || !c.HttpOnly || c.Secure != tt.tls {
+			t.Errorf("%s: unexpected cookie %v", tt.name, c)
+		}
+	}
+}
+
+// newAPIServer serves the REST API of the hub behind a test HTTP server.
+func newAPIServer(t *testing.T, h *Hub) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeMessages))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// post sends a request body to the REST API and returns the status and the
+// response body.
+func post(t *testing.T, srv *httptest.Server, query string, body string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/api/messages?"+query, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestAPIPost(t *testing.T) {
+	h, _ := newTestServer(t)
+	srv := newAPIServer(t, h)
+	tests := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+		want   string
+	}{
+		{"message", "frequency=868", `{"callsign": "A", "body": "hi"}`, http.StatusCreated,
+			`"callsign":"A","body":"hi","seq":1,"direction":"out"`},
+		{"no callsign", "frequency=868", `{"body": "[B]: hi"}`, http.StatusCreated, `"callsign":"B","body":"hi"`},
+		{"invalid JSON", "frequency=868", `{"callsign": "A", "body": `, http.StatusBadRequest, "must be a JSON object"},
+		{"not an object", "frequency=868", `"hi"`, http.StatusBadRequest, "must be a JSON object"},
+		{"empty body", "frequency=868", `{"callsign": "A", "body": " "}`, http.StatusBadRequest, "must not be empty"},
+		{"two lines", "frequency=868", `{"callsign": "A", "body": "hi\nthere"}`, http.StatusBadRequest, "single line"},
+		{"invalid params", "frequency=1&bandwidth=300", `{"callsign": "A", "body": "hi"}`, http.StatusBadRequest,
+			`"fields":[{"field":"frequency"`},
+		{"oversized body", "frequency=868", `{"callsign": "A", "body": "` + strings.Repeat("x", apiMaxBody) + `"}`,
+			http.StatusRequestEntityTooLarge, "request body is too large"},
+		{"too long", "frequency=868", `{"callsign": "A", "body": "` + strings.Repeat("x", MAX_FRAGMENTED_LENGTH+1) + `"}`,
+			http.StatusRequestEntityTooLarge, "body is too long"},
+	}
+	for _, tt := range tests {
+		status, body := post(t, srv, tt.query, tt.body)
+		if status != tt.status || !strings.Contains(body, tt.want) {
+			t.Errorf("%s: expected %d with %q, got %d: %s", tt.name, tt.status, tt.want, status, body)
+		}
+	}
+
+	var f Frame
+	if _, body := post(t, srv, "frequency=868", `{"callsign": "A", "body": "again"}`); json.Unmarshal([]byte(body), &f) != nil ||
+		f.Callsign != "A" || f.Body != "again" || f.Direction != DIRECTION_OUT || f.Seq == 0 {
+		t.Errorf("unexpected frame for the posted message: %s", body)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/messages", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("PUT: expected 405, got %d with Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestAPIGet(t *testing.T) {
+	h, _ := newTestServer(t)
+	srv := newAPIServer(t, h)
+	params, err := defaultRadioParams.withQuery(url.Values{"frequency": {"868"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		h.History.Record(params, DIRECTION_IN, fmt.Sprintf("[A]: %d", i))
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		seqs   string
+	}{
+		{"frequency=868", http.StatusOK, "1 2 3 4 5"},
+		{"frequency=868&since=2", http.StatusOK, "3 4 5"},
+		{"frequency=868&limit=2", http.StatusOK, "4 5"},
+		{"frequency=868&since=1&limit=3", http.StatusOK, "3 4 5"},
+		{"frequency=868&since=2&limit=0", http.StatusOK, "3 4 5"},
+		{"frequency=868&since=5", http.StatusOK, ""},
+		{"frequency=915", http.StatusOK, ""},
+		{"frequency=868&since=abc", http.StatusBadRequest, ""},
+		{"frequency=868&since=-1", http.StatusBadRequest, ""},
+		{"frequency=868&limit=-1", http.StatusBadRequest, ""},
+		{"frequency=868&limit=x", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/api/messages?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Params   RadioParams
+			Messages []Frame
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.query, tt.status, resp.StatusCode)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: cannot decode the response: %v", tt.query, err)
+			continue
+		}
+		var seqs []string
+		for _, f := range got.Messages {
+			seqs = append(seqs, strconv.FormatUint(f.Seq, 10))
+			if f.Callsign != "A" || f.Body != strconv.FormatUint(f.Seq, 10) {
+				t.Errorf("%s: unexpected frame %+v", tt.query, f)
+			}
+		}
+		if strings.Join(seqs, " ") != tt.seqs {
+			t.Errorf("%s: expected seqs %q, got %q", tt.query, tt.seqs, seqs)
+		}
+		q, _ := url.ParseQuery(tt.query)
+		if want, _ := defaultRadioParams.withQuery(q); got.Params != want {
+			t.Errorf("%s: expected params %v, got %v", tt.query, want, got.Params)
+		}
+	}
+}
+
+func TestAPILinger(t *testing.T) {
+	h, sock := newTestServer(t)
+	h.APILinger = 1 * time.Second
+	srv := newAPIServer(t, h)
+
+	// Each request keeps the radio running for another APILinger
+	if status, body := post(t, srv, "frequency=868", `{"callsign": "A", "body": "one"}`); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, body)
+	}
+	r := radio(t, h, "frequency=868")
+	time.Sleep(600 * time.Millisecond)
+	if status, body := post(t, srv, "frequency=868", `{"callsign": "A", "body": "two"}`); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, body)
+	}
+	time.Sleep(600 * time.Millisecond)
+	select {
+	case <-r.done:
+		t.Fatal("radio stopped before APILinger after the last request")
+	default:
+	}
+	expectStopped(t, h, r)
+
+	// A websocket client keeps the radio running after the lease expires
+	a := dial(t, sock, "frequency=868", false)
+	a.expect("radio started")
+	r = radio(t, h, "frequency=868")
+	if status, body := post(t, srv, "frequency=868", `{"callsign": "B", "body": "via api"}`); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, body)
+	}
+	a.expect("[B]: via api")
+	time.Sleep(h.APILinger + 200*time.Millisecond)
+	select {
+	case <-r.done:
+		t.Fatal("radio stopped while a websocket client was attached")
+	default:
+	}
+	a.ws.Close()
+	expectStopped(t, h, r)
+}
+
+func TestParseReplay(t *testing.T) {
+	h := NewHub("")
+	tests := []struct {
+		query  string
+		replay *replay
+		err    bool
+	}{
+		{"", &replay{limit: DEFAULT_HISTORY_REPLAY}, false},
+		{"history=5", &replay{limit: 5}, false},
+		{"history=0", nil, false},
+		{"since=7", &replay{since: 7}, false},
+		{"since=0", &replay{}, false},
+		{"since=7&history=3", &replay{since: 7, limit: 3}, false},
+		{"since=7&history=0", nil, false},
+		{"history=-1", nil, true},
+		{"history=x", nil, true},
+		{"since=-1", nil, true},
+		{"since=x&history=3", nil, true},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		rp, err := h.parseReplay(q)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.query, err)
+			continue
+		}
+		if (rp == nil) != (tt.replay == nil) || (rp != nil && *rp != *tt.replay) {
+			t.Errorf("%q: expected %+v, got %+v", tt.query, tt.replay, rp)
+		}
+	}
+
+	h.HistoryReplay = 0
+	if rp, err := h.parseReplay(url.Values{}); rp != nil || err != nil {
+		t.Errorf("replay with HistoryReplay 0: got %+v, %v", rp, err)
+	}
+	if rp, err := h.parseReplay(url.Values{"since": {"3"}}); err != nil || rp == nil || *rp != (replay{since: 3}) {
+		t.Errorf("since with HistoryReplay 0: got %+v, %v", rp, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	h, srv := newTestServer(t)
+	for i := 1; i <= 30; i++ {
+		h.History.Record(defaultRadioParams, DIRECTION_IN, fmt.Sprintf("[A]: %d", i))
+	}
+	tests := []struct {
+		query string
+		seqs  string
+	}{
+		{"", "11 12 13 14 15 16 17 18 19 20 21 22 23 24 25 26 27 28 29 30"},
+		{"history=3", "28 29 30"},
+		{"history=0", ""},
+		{"since=25", "26 27 28 29 30"},
+		{"since=5&history=2", "29 30"},
+		{"since=30", ""},
+	}
+	for _, tt := range tests {
+		c := dial(t, srv, tt.query, true)
+		var seqs []string
+	replay:
+		for {
+			select {
+			case msg, ok := <-c.messages:
+				if !ok {
+					t.Fatalf("%q: connection closed", tt.query)
+				}
+				if strings.Contains(msg, "radio started") || strings.Contains(msg, "joined running radio") {
+					break replay
+				}
+				var f Frame
+				if err := json.Unmarshal([]byte(msg), &f); err != nil {
+					t.Fatal(err)
+				}
+				seqs = append(seqs, strconv.FormatUint(f.Seq, 10))
+			case <-time.After(testTimeout):
+				t.Fatalf("%q: timed out waiting for the replay", tt.query)
+			}
+		}
+		if strings.Join(seqs, " ") != tt.seqs {
+			t.Errorf("%q: expected seqs %q, got %q", tt.query, tt.seqs, seqs)
+		}
+		c.ws.Close()
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	dir := t.TempDir()
+	other, err := defaultRadioParams.withQuery(url.Values{"frequency": {"868"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 7; i++ {
+		history.Record(defaultRadioParams, DIRECTION_IN, fmt.Sprintf("[A]: %d", i))
+	}
+	history.Record(other, DIRECTION_OUT, "[B]: elsewhere")
+	history.Close()
+
+	// The seventh line went over twice the size, so the file was compacted
+	path := filepath.Join(dir, historyFileName(defaultRadioParams))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines in the compacted file, got %d:\n%s", lines, b)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// Lines that cannot be read back are skipped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+
+	history, err = NewHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	seqs := func(entries []HistoryEntry) string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, strconv.FormatUint(e.Seq, 10)+":"+e.Line)
+		}
+		return strings.Join(s, " ")
+	}
+	if got := seqs(history.Since(defaultRadioParams, 0, 0)); got != "5:[A]: 5 6:[A]: 6 7:[A]: 7" {
+		t.Errorf("unexpected entries after reload: %s", got)
+	}
+	if e := history.Record(defaultRadioParams, DIRECTION_IN, "[A]: 8"); e.Seq != 8 {
+		t.Errorf("sequence numbers restarted after reload: %d", e.Seq)
+	}
+	if got := seqs(history.Since(defaultRadioParams, 6, 0)); got != "7:[A]: 7 8:[A]: 8" {
+		t.Errorf("unexpected entries since 6: %s", got)
+	}
+	entries := history.Since(other, 0, 0)
+	if got := seqs(entries); got != "1:[B]: elsewhere" || entries[0].Direction != DIRECTION_OUT {
+		t.Errorf("unexpected entries for the other radio: %+v", entries)
+	}
+}
+
+func TestCommandExpand(t *testing.T) {
+	params, err := defaultRadioParams.withQuery(url.Values{
+		"frequency": {"868.1"}, "bandwidth": {"200"}, "spreadingFactor": {"7"}, "codingRate": {"8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string
+		err  bool
+	}{
+		{nil, "", false},
+		{DEFAULT_ARGS, "-f|868.1|-b|52|-s|112|-c|4", false},
+		{[]string{"--freq={frequency}MHz", "{bandwidth}/{sf}/{cr}"}, "--freq=868.1MHz|200/7/8", false},
+		{[]string{"{sf}{sf.reg}", "{frequency"}, "7112|{frequency", false},
+		{[]string{"{cr}", "{power}"}, "", true},
+		{[]string{"{Frequency}"}, "", true},
+		{[]string{"-s", "{sf.value}"}, "", true},
+	}
+	for _, tt := range tests {
+		args, err := Command{Path: "chat", Args: tt.args}.expand(params)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.args, err)
+			continue
+		}
+		if !tt.err && strings.Join(args, "|") != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.args, tt.want, args)
+		}
+	}
+	if args, _ := (Command{Args: []string{"{frequency}"}}).expand(defaultRadioParams); args[0] != "1000" {
+		t.Errorf("expected the default frequency, got %q", args)
+	}
+}
+
+func TestCommandCheck(t *testing.T) {
+	tests := []struct {
+		cmd Command
+		err string
+	}{
+		{Command{Path: "chat"}, ""},
+		{Command{Path: "chat", Args: DEFAULT_ARGS, Env: []string{"A=1", "B=", "C=x=y"}}, ""},
+		{Command{Path: "chat", Args: []string{"-p", "{power}"}}, `unknown placeholder {power} in argument "{power}"`},
+		{Command{Path: "chat", Env: []string{"A"}}, `environment variable "A" is not in NAME=VALUE form`},
+		{Command{Path: "chat", Env: []string{"=1"}}, `environment variable "=1" is not in NAME=VALUE form`},
+	}
+	for _, tt := range tests {
+		err := tt.cmd.Check()
+		if got := fmt.Sprint(err); (err == nil) != (tt.err == "") || (err != nil && got != tt.err) {
+			t.Errorf("%+v: expected error %q, got %v", tt.cmd, tt.err, err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"   ", nil, false},
+		{"-f {frequency}", []string{"-f", "{frequency}"}, false},
+		{" a\tb\nc  ", []string{"a", "b", "c"}, false},
+		{`--name "two words" 'single quoted'`, []string{"--name", "two words", "single quoted"}, false},
+		{`--opt="a b"c`, []string{"--opt=a bc"}, false},
+		{`"it's" '"quoted"'`, []string{"it's", `"quoted"`}, false},
+		{`"" ''`, []string{"", ""}, false},
+		{`a""b`, []string{"ab"}, false},
+		{`"unterminated`, nil, true},
+		{`a 'b`, nil, true},
+	}
+	for _, tt := range tests {
+		args, err := SplitArgs(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.line, err)
+			continue
+		}
+		if fmt.Sprintf("%q", args) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%q: expected %q, got %q", tt.line, tt.want, args)
+		}
+	}
+}
+
+func TestHistogramSeries(t *testing.T) {
+	h := newHistogram(1, 2.5)
+	for _, v := range []float64{0.5, 1, 2, 7} {
+		h.observe(v)
+	}
+	var b bytes.Buffer
+	h.writeSeries(&b, "test_seconds", "")
+	h.writeSeries(&b, "test_seconds", `direction="in"`)
+	want := `test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="2.5"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 10.5
+test_seconds_count 4
+test_seconds_bucket{direction="in",le="1"} 2
+test_seconds_bucket{direction="in",le="2.5"} 3
+test_seconds_bucket{direction="in",le="+Inf"} 4
+test_seconds_sum{direction="in"} 10.5
+test_seconds_count{direction="in"} 4
+`
+	if b.String() != want {
+		t.Errorf("unexpected series:\n%s", b.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h, srv := newTestServer(t)
+	a := dial(t, srv, "", false)
+	a.expect("radio started")
+	a.send("[A]: counted")
+	a.expect("[A]: counted")
+
+	w := httptest.NewRecorder()
+	h.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected response %d with content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	families := map[string]string{
+		"wschat_sessions":                "gauge",
+		"wschat_transmit_queue":          "gauge",
+		"wschat_processes_spawned_total": "counter",
+		"wschat_process_restarts_total":  "counter",
+		"wschat_messages_total":          "counter",
+		"wschat_garbled_total":           "counter",
+		"wschat_diagnostics_total":       "counter",
+		"wschat_duplicates_total":        "counter",
+		"wschat_write_errors_total":      "counter",
+		"wschat_ping_failures_total":     "counter",
+		"wschat_socket_write_seconds":    "histogram",
+		"wschat_message_size_bytes":      "histogram",
+	}
+	headerRe := regexp.MustCompile(`^# (HELP|TYPE) ([a-z_]+) (.+)$`)
+	sampleRe := regexp.MustCompile(`^([a-z_]+)(\{[a-z]+="[^"\\]*"(,[a-z]+="[^"\\]*")*\})? (\S+)$`)
+	seen := map[string]string{}
+	samples := map[string]string{}
+	family := ""
+	for i, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if m := headerRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "HELP" {
+				if _, ok := seen[m[2]]; ok {
+					t.Errorf("line %d: %s is described twice", i+1, m[2])
+				}
+				seen[m[2]] = ""
+				family = m[2]
+			} else if m[2] != family {
+				t.Errorf("line %d: TYPE of %s does not follow its HELP", i+1, m[2])
+			} else {
+				seen[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sampleRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %d: malformed sample %q", i+1, line)
+			continue
+		}
+		name := m[1]
+		if seen[family] == "histogram" {
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		}
+		if name != family {
+			t.Errorf("line %d: sample %s is not part of %s", i+1, m[1], family)
+		}
+		if _, err := strconv.ParseFloat(m[4], 64); err != nil {
+			t.Errorf("line %d: invalid value %q", i+1, m[4])
+		}
+		samples[m[1]+m[2]] = m[4]
+	}
+	for name, typ := range families {
+		if seen[name] != typ {
+			t.Errorf("%s: expected type %s, got %q", name, typ, seen[name])
+		}
+	}
+	if len(seen) != len(families) {
+		t.Errorf("unexpected metrics: %v", seen)
+	}
+
+	for _, series := range []string{
+		`wschat_messages_total{direction="in"}`,
+		`wschat_messages_total{direction="out"}`,
+		`wschat_message_size_bytes_count{direction="out"}`,
+		`wschat_message_size_bytes_bucket{direction="out",le="+Inf"}`,
+		`wschat_socket_write_seconds_count`,
+		`wschat_processes_spawned_total`,
+		`wschat_sessions`,
+	} {
+		if v, err := strconv.ParseFloat(samples[series], 64); err != nil || v < 1 {
+			t.Errorf("%s: expected at least 1, got %q", series, samples[series])
+		}
+	}
+	for _, series := range []string{
+		`wschat_write_errors_total{target="stdin"}`,
+		`wschat_write_errors_total{target="socket"}`,
+		`wschat_message_size_bytes_sum{direction="in"}`,
+		`wschat_socket_write_seconds_bucket{le="0.0005"}`,
+	} {
+		if _, ok := samples[series]; !ok {
+			t.Errorf("%s: missing", series)
+		}
+	}
+	if samples[`wschat_message_size_bytes_bucket{direction="in",le="+Inf"}`] != samples[`wschat_message_size_bytes_count{direction="in"}`] {
+		t.Error("+Inf bucket does not match the count")
+	}
+
+	h.Access = &AccessControl{Token: "s3cret"}
+	w = httptest.NewRecorder()
+	h.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("scrape without the token: expected 401, got %d", w.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package command_socket
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How repeated copies of a received message are handled
+const (
+	DEDUP_OFF   = "off"   // Every copy is shown
+	DEDUP_DROP  = "drop"  // Copies are dropped
+	DEDUP_COUNT = "count" // Copies are dropped, and clients are told how many arrived
+)
+
+// Default time during which copies of a message are recognized
+const DEFAULT_DEDUP_WINDOW = 30 * time.Second
+
+// DedupConfig describes how a radio suppresses duplicate messages, such as
+// the copies sent by repeaters or retransmitted by the sender. Two messages
+// are the same if they have the same callsign, text and delivery tag, and the
+// second arrives within Window of the first.
+type DedupConfig struct {
+	Mode   string
+	Window time.Duration
+}
+
+func (d DedupConfig) Validate() error {
+	switch d.Mode {
+	case DEDUP_OFF, DEDUP_DROP, DEDUP_COUNT:
+	default:
+		return fmt.Errorf("dedup mode must be %s, %s or %s", DEDUP_OFF, DEDUP_DROP, DEDUP_COUNT)
+	}
+	if d.Mode != DEDUP_OFF && d.Window <= 0 {
+		return fmt.Errorf("dedup window must be positive")
+	}
+	return nil
+}
+
+// ParseDedupRule reads the duplicate suppression settings for one radio
+// configuration. The rule uses the query string format of /sock, with the
+// dedup and dedupWindow parameters on top of the radio parameters, as in
+// "frequency=868&spreadingFactor=9&dedup=count&dedupWindow=2m". Settings
+// that are left out are taken from def.
+func ParseDedupRule(rule string, def DedupConfig) (RadioParams, DedupConfig, error) {
+	q, err := url.ParseQuery(rule)
+	if err != nil {
+		return RadioParams{}, def, err
+	}
+	params, err := defaultRadioParams.withQuery(q)
+	if err != nil {
+		return params, def, err
+	}
+	d := def
+	if q.Get("dedup") != "" {
+		d.Mode = q.Get("dedup")
+	}
+	if q.Get("dedupWindow") != "" {
+		if d.Window, err = time.ParseDuration(q.Get("dedupWindow")); err != nil {
+			return params, d, fmt.Errorf("invalid dedup window: %v", err)
+		}
+	}
+	return params, d, d.Validate()
+}
+
+// dedupFor returns the duplicate suppression settings of a radio.
+func (h *Hub) dedupFor(params RadioParams) DedupConfig {
+	if d, ok := h.DedupRadios[params]; ok {
+		return d
+	}
+	return h.Dedup
+}
+
+type dedupKey [sha256.Size]byte
+
+// seenMessage is the first copy of a message received within the window.
+type seenMessage struct {
+	key     dedupKey
+	at      time.Time
+	frameID string
+	repeats int
+}
+
+// deduplicator remembers the messages received within the window.
+type deduplicator struct {
+	DedupConfig
+
+	mu     sync.Mutex
+	seen   map[dedupKey]*seenMessage
+	recent []*seenMessage // Oldest first
+}
+
+func newDeduplicator(config DedupConfig) *deduplicator {
+	return &deduplicator{DedupConfig: config, seen: map[dedupKey]*seenMessage{}}
+}
+
+// check reports whether the message is a copy of one received within the
+// window, and returns the first copy with its repeat count updated.
+// Otherwise it remembers the message as published in the frame with the
+// given id.
+func (d *deduplicator) check(callsign string, body string, tag string, frameID string) (*seenMessage, bool) {
+	now := time.Now()
+	key := dedupKey(sha256.Sum256([]byte(callsign + "\x00" + body + "\x00" + tag)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.recent) > 0 && now.Sub(d.recent[0].at) > d.Window {
+		delete(d.seen, d.recent[0].key)
+		d.recent = d.recent[1:]
+	}
+	if m := d.seen[key]; m != nil {
+		m.repeats++
+		first := *m
+		return &first, true
+	}
+	m := &seenMessage{key: key, at: now, frameID: frameID}
+	d.seen[key] = m
+	d.recent = append(d.recent, m)
+	return nil, false
+}
+
+func repeatFrame(m *seenMessage) Frame {
+	f := newFrame(FRAME_REPEAT, "")
+	f.ID = m.frameID
+	f.Repeats = m.repeats
+	return f
+}
@@ -0,0 +1,230 @@
+package command_socket
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// States reported in delivery frames
+const (
+	DELIVERY_QUEUED      = "queued"      // Waiting for the chat program to accept it
+	DELIVERY_TRANSMITTED = "transmitted" // Accepted by the chat program
+	DELIVERY_ACKED       = "acked"       // Acknowledged by the station in the callsign field
+	DELIVERY_TIMED_OUT   = "timed out"   // No acknowledgement arrived in time
+)
+
+// Default time to wait for an acknowledgement before retransmitting or
+// giving up
+const DEFAULT_ACK_TIMEOUT = 30 * time.Second
+
+// With acknowledgements enabled, the text of an outgoing message starts with
+// a "~m:id~" tag, where id is three base 36 digits. Stations that follow the
+// same convention answer with a message whose text is "~ack:id~".
+var (
+	messageTagRe = regexp.MustCompile(`^~m:([0-9a-z]{3})~(.*)$`)
+	ackTagRe     = regexp.MustCompile(`^~ack:([0-9a-z]{3})~$`)
+)
+
+// trackedMessage tracks a message sent with a tag until it is acknowledged or
+// times out.
+type trackedMessage struct {
+	client   *client
+	frameID  string
+	line     []byte
+	attempts int
+	acked    bool
+	timer    *time.Timer
+}
+
+func deliveryFrame(id string, state string, attempt int) Frame {
+	f := newFrame(FRAME_DELIVERY, state)
+	f.ID = id
+	f.Attempt = attempt
+	return f
+}
+
+// callsignOf returns the callsign in a prefix returned by splitLine.
+func callsignOf(prefix string) string {
+	if m := callsignRe.FindStringSubmatch(strings.TrimPrefix(prefix, ">")); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// outgoing is a message from a client waiting in the transmit queue.
+type outgoing struct {
+	c   *client
+	id  string
+	msg []byte
+	job *txJob
+
+	// Delivery tag of the message, empty without acknowledgements
+	tag string
+}
+
+// send writes a message from the client to the chat program and reports its
+// delivery state to the client under the given frame id. With
+// acknowledgements enabled, the message is tagged and tracked until a peer
+// acknowledges it, and retransmitted when it times out.
+func (r *Radio) send(c *client, id string, msg []byte, cancel <-chan struct{}) (HistoryEntry, error) {
+	o, err := r.queueMessage(c, id, msg)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	return r.awaitMessage(o, cancel)
+}
+
+// queueMessage implements the first half of send. It queues the message and
+// returns without waiting for it to be written, so that the client can go on
+// sending messages.
+func (r *Radio) queueMessage(c *client, id string, msg []byte) (*outgoing, error) {
+	queued := func(ahead int, eta time.Time) {
+		r.unicast(c, queuedFrame(id, 1, ahead, eta))
+	}
+	o := &outgoing{c: c, id: id, msg: msg}
+	if !r.hub.Acks {
+		j, err := r.enqueue(msg, true, queued)
+		if err != nil {
+			return nil, err
+		}
+		o.job = j
+		return o, nil
+	}
+
+	o.tag = newFragmentID()
+	prefix, text := splitLine(string(msg))
+	d := &trackedMessage{
+		client:   c,
+		frameID:  id,
+		line:     []byte(prefix + "~m:" + o.tag + "~" + text),
+		attempts: 1,
+	}
+
+	// Register the message first, so that an echo from the chat program is
+	// recognized as our own
+	r.deliveryMu.Lock()
+	r.deliveries[o.tag] = d
+	r.deliveryMu.Unlock()
+
+	j, err := r.enqueue(d.line, true, queued)
+	if err != nil {
+		r.forgetDelivery(o.tag)
+		return nil, err
+	}
+	o.job = j
+	return o, nil
+}
+
+// awaitMessage implements the second half of send. It waits until the
+// queued message is written, records it in the history and starts waiting
+// for its acknowledgement.
+func (r *Radio) awaitMessage(o *outgoing, cancel <-chan struct{}) (HistoryEntry, error) {
+	if err := r.await(o.job, cancel); err != nil {
+		if o.tag != "" {
+			r.forgetDelivery(o.tag)
+		}
+		return HistoryEntry{}, err
+	}
+	r.unicast(o.c, deliveryFrame(o.id, DELIVERY_TRANSMITTED, 1))
+	e := r.hub.History.Record(r.params, DIRECTION_OUT, string(o.msg))
+	if o.tag == "" {
+		return e, nil
+	}
+
+	r.deliveryMu.Lock()
+	if d := r.deliveries[o.tag]; d != nil {
+		tag := o.tag
+		d.timer = time.AfterFunc(r.hub.AckTimeout, func() { r.ackTimeout(tag) })
+	}
+	r.deliveryMu.Unlock()
+	return e, nil
+}
+
+func (r *Radio) forgetDelivery(tag string) {
+	r.deliveryMu.Lock()
+	delete(r.deliveries, tag)
+	r.deliveryMu.Unlock()
+}
+
+// ackTimeout retransmits the message if it has attempts left, and otherwise
+// forgets it, telling the client if nobody acknowledged it.
+func (r *Radio) ackTimeout(tag string) {
+	r.deliveryMu.Lock()
+	d := r.deliveries[tag]
+	if d == nil {
+		r.deliveryMu.Unlock()
+		return
+	}
+	if d.acked || d.attempts > r.hub.Retransmits {
+		delete(r.deliveries, tag)
+		r.deliveryMu.Unlock()
+		if !d.acked {
+			r.unicast(d.client, deliveryFrame(d.frameID, DELIVERY_TIMED_OUT, d.attempts))
+		}
+		return
+	}
+	d.attempts++
+	attempt := d.attempts
+	r.deliveryMu.Unlock()
+
+	queued := func(ahead int, eta time.Time) {
+		r.unicast(d.client, queuedFrame(d.frameID, attempt, ahead, eta))
+	}
+	if err := r.transmit(d.line, false, nil, queued); err != nil {
+		return
+	}
+	r.unicast(d.client, deliveryFrame(d.frameID, DELIVERY_TRANSMITTED, attempt))
+
+	r.deliveryMu.Lock()
+	if r.deliveries[tag] == d {
+		d.timer.Reset(r.hub.AckTimeout)
+	}
+	r.deliveryMu.Unlock()
+}
+
+// acked reports an acknowledgement from the station with the callsign. Every
+// station that acknowledges the message before it is forgotten is reported.
+func (r *Radio) acked(tag string, callsign string) {
+	r.deliveryMu.Lock()
+	d := r.deliveries[tag]
+	if d == nil {
+		r.deliveryMu.Unlock()
+		return
+	}
+	d.acked = true
+	frameID, attempts, c := d.frameID, d.attempts, d.client
+	r.deliveryMu.Unlock()
+
+	f := deliveryFrame(frameID, DELIVERY_ACKED, attempts)
+	f.Callsign = callsign
+	r.unicast(c, f)
+}
+
+// isOwn reports whether the tag belongs to a message sent by this radio.
+func (r *Radio) isOwn(tag string) bool {
+	r.deliveryMu.Lock()
+	defer r.deliveryMu.Unlock()
+	return r.deliveries[tag] != nil
+}
+
+// sendAck acknowledges a tagged message from a peer.
+func (r *Radio) sendAck(tag string) {
+	line := "~ack:" + tag + "~"
+	if r.hub.Callsign != "" {
+		line = "[" + r.hub.Callsign + "]: " + line
+	}
+	r.transmit([]byte(line), false, nil, nil)
+}
+
+// stopDeliveries forgets the tracked messages once the radio is stopped.
+func (r *Radio) stopDeliveries() {
+	r.deliveryMu.Lock()
+	defer r.deliveryMu.Unlock()
+	for tag, d := range r.deliveries {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(r.deliveries, tag)
+	}
+}
@@ -1,5 +1,11 @@
 package command_socket
 
+import "errors"
+
+var UNAVAILABLE = errors.New("radio is not available")
+var TOO_LONG = errors.New("message is too long")
+var INCOMPLETE = errors.New("incomplete")
+
 type Error struct {
 	err error
 	msg string
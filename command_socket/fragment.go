@@ -0,0 +1,196 @@
+package command_socket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Number of characters the radio reliably carries in one message, not
+	// counting the "[callsign]: " prefix
+	MAX_MESSAGE_LENGTH = 47
+
+	// Most fragments a message can be split into
+	MAX_FRAGMENTS = 9
+
+	// How long to wait for the missing fragments of a message
+	fragmentTimeout = 2 * time.Minute
+)
+
+// Fragments carry a "~id:i/n~" header in front of their text, where id is
+// three base 36 digits shared by all fragments of a message.
+var fragmentRe = regexp.MustCompile(`^~([0-9a-z]{3}):([1-9])/([1-9])~(.*)$`)
+
+const fragmentHeaderLength = len("~abc:1/9~")
+
+// Longest message that can be sent in fragments
+const MAX_FRAGMENTED_LENGTH = MAX_FRAGMENTS * (MAX_MESSAGE_LENGTH - fragmentHeaderLength)
+
+func newFragmentID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	id := strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[:])%(36*36*36)), 36)
+	return strings.Repeat("0", 3-len(id)) + id
+}
+
+// splitLine separates the optional prompt and "[callsign]: " prefix from the
+// text of a line.
+func splitLine(line string) (prefix string, text string) {
+	s := strings.TrimPrefix(line, ">")
+	prompt := line[:len(line)-len(s)]
+	if m := callsignRe.FindStringSubmatch(s); m != nil {
+		return prompt + "[" + m[1] + "]: ", strings.TrimPrefix(m[2], " ")
+	}
+	return prompt, s
+}
+
+// fragment splits a line whose text is longer than MAX_MESSAGE_LENGTH into
+// several lines with a fragment header. Shorter lines are returned as is.
+func fragment(line []byte) ([][]byte, error) {
+	prefix, text := splitLine(string(line))
+	runes := []rune(text)
+	if len(runes) <= MAX_MESSAGE_LENGTH {
+		return [][]byte{line}, nil
+	}
+	if len(runes) > MAX_FRAGMENTED_LENGTH {
+		return nil, TOO_LONG
+	}
+
+	// Cut the text so that no fragment starts or ends with white space,
+	// which the chat program might strip
+	size := MAX_MESSAGE_LENGTH - fragmentHeaderLength
+	badCut := func(i int) bool {
+		return unicode.IsSpace(runes[i-1]) || unicode.IsSpace(runes[i])
+	}
+	var chunks []string
+	for start := 0; start < len(runes); {
+		end := start + size
+		if end >= len(runes) {
+			end = len(runes)
+		} else {
+			for end > start+1 && badCut(end) {
+				end--
+			}
+			if badCut(end) {
+				// No good place to cut in a run of white space
+				end = start + size
+			}
+		}
+		chunks = append(chunks, string(runes[start:end]))
+		start = end
+	}
+	if len(chunks) > MAX_FRAGMENTS {
+		return nil, TOO_LONG
+	}
+
+	id := newFragmentID()
+	lines := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		lines[i] = []byte(fmt.Sprintf("%s~%s:%d/%d~%s", prefix, id, i+1, len(chunks), chunk))
+	}
+	return lines, nil
+}
+
+// partialMessage collects the fragments of one message.
+type partialMessage struct {
+	prefix   string // "[callsign]: " without the prompt, or empty
+	parts    []string
+	received int
+	deadline time.Time
+}
+
+// reassembler joins fragments printed by the chat program back into whole
+// lines. It is only used from the goroutine reading the program's output.
+type reassembler struct {
+	partial map[string]*partialMessage
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{partial: map[string]*partialMessage{}}
+}
+
+// add takes a line printed by the chat program. Lines that are not fragments
+// are returned as they are. Fragments are held until the message is
+// complete, and then the whole line is returned without the prompt, which
+// the chat program prints in front of some fragments and not others.
+func (ra *reassembler) add(line []byte) ([]byte, bool) {
+	prefix, text := splitLine(string(line))
+	m := fragmentRe.FindStringSubmatch(text)
+	if m == nil {
+		return line, true
+	}
+	i, _ := strconv.Atoi(m[2])
+	n, _ := strconv.Atoi(m[3])
+	if i > n {
+		return line, true
+	}
+
+	callsign := callsignOf(prefix)
+	if callsign != "" {
+		prefix = "[" + callsign + "]: "
+	} else {
+		prefix = ""
+	}
+	key := callsign + "~" + m[1]
+	p, ok := ra.partial[key]
+	if !ok || len(p.parts) != n {
+		p = &partialMessage{
+			prefix:   prefix,
+			parts:    make([]string, n),
+			deadline: time.Now().Add(fragmentTimeout),
+		}
+		ra.partial[key] = p
+	}
+	if p.parts[i-1] == "" {
+		p.parts[i-1] = m[4]
+		p.received++
+	}
+	if p.received < n {
+		return nil, false
+	}
+	delete(ra.partial, key)
+	return []byte(p.prefix + strings.Join(p.parts, "")), true
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
+
+// incompleteMessage is a message whose fragments did not all arrive in time.
+type incompleteMessage struct {
+	line    []byte
+	missing []int
+	total   int
+}
+
+// expire removes the messages that have been waiting for too long and
+// returns what was received of them.
+func (ra *reassembler) expire(now time.Time) []incompleteMessage {
+	var expired []incompleteMessage
+	for key, p := range ra.partial {
+		if now.Before(p.deadline) {
+			continue
+		}
+		delete(ra.partial, key)
+		m := incompleteMessage{total: len(p.parts)}
+		for i, part := range p.parts {
+			if part == "" {
+				m.missing = append(m.missing, i+1)
+				p.parts[i] = "…"
+			}
+		}
+		m.line = []byte(p.prefix + strings.Join(p.parts, ""))
+		expired = append(expired, m)
+	}
+	return expired
+}
@@ -0,0 +1,130 @@
+package command_socket
+
+import (
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Subprotocol that clients request to receive JSON frames instead of plain
+// text lines
+const JSON_PROTOCOL = "wschat.json.v1"
+
+const (
+	FRAME_MESSAGE = "message" // Chat line sent over the radio
+	FRAME_SYSTEM  = "system"  // Output of the chat program that is not a chat line
+	FRAME_ERROR   = "error"   // Something went wrong on the server
+	FRAME_STATUS  = "status"  // Change in the state of the radio or session
+	FRAME_ACK     = "ack"     // Client's message was handed to the chat program
+	FRAME_TUNE    = "tune"    // Client asks to change the radio parameters
+
+	FRAME_DELIVERY   = "delivery"   // Delivery state of the client's message
+	FRAME_REPEAT     = "repeat"     // Another copy of an earlier message arrived
+	FRAME_DIAGNOSTIC = "diagnostic" // Line written by the chat program to its standard error
+	FRAME_RANGE_TEST = "rangetest"  // Progress of a range test
+)
+
+// Prefix of the plain text command that changes the radio parameters, for
+// example "/tune frequency=868&bandwidth=800"
+const TUNE_COMMAND = "/tune "
+
+var callsignRe = regexp.MustCompile(`^\[([^\]]+)]:(.*)$`)
+
+var frameCounter uint64
+
+// Frame is a single event delivered to the websocket clients. JSON clients
+// receive it as is, while plain text clients only receive the original line.
+type Frame struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Callsign  string    `json:"callsign,omitempty"`
+	Body      string    `json:"body"`
+
+	// Position of the line in the history, and whether it was read from or
+	// written to the chat program
+	Seq       uint64 `json:"seq,omitempty"`
+	Direction string `json:"direction,omitempty"`
+
+	// Radio parameters requested by a tune frame, or currently in effect
+	Params *RadioParams `json:"params,omitempty"`
+
+	// Transmission the delivery state is about, starting from 1
+	Attempt int `json:"attempt,omitempty"`
+
+	// Reception metadata of a message, such as its RSSI and SNR
+	RX *RXMetadata `json:"rx,omitempty"`
+
+	// Number of copies of the message received after the first one
+	Repeats int `json:"repeats,omitempty"`
+
+	// Messages ahead of a queued message, and when it should be sent
+	Queue int        `json:"queue,omitempty"`
+	ETA   *time.Time `json:"eta,omitempty"`
+
+	// Probe a range test frame is about, and the statistics of the test so
+	// far
+	Probe *ProbeResult    `json:"probe,omitempty"`
+	Stats *RangeTestStats `json:"stats,omitempty"`
+
+	// Text sent to plain text clients, empty if they should not see the frame
+	text string
+}
+
+func newFrameID() string {
+	return strconv.FormatUint(atomic.AddUint64(&frameCounter, 1), 36)
+}
+
+func newFrame(typ string, body string) Frame {
+	return Frame{
+		Type:      typ,
+		ID:        newFrameID(),
+		Timestamp: time.Now(),
+		Body:      body,
+	}
+}
+
+// historyFrame replays a line recorded in the history.
+func (h *Hub) historyFrame(e HistoryEntry) Frame {
+	f := eventFrame(h.parse(e.Line), e.Line)
+	f.Timestamp = e.Timestamp
+	f.Seq = e.Seq
+	f.Direction = e.Direction
+	return f
+}
+
+func diagnosticFrame(line string) Frame {
+	f := newFrame(FRAME_DIAGNOSTIC, line)
+	f.text = line
+	return f
+}
+
+func errorFrame(err Error) Frame {
+	f := newFrame(FRAME_ERROR, err.msg)
+	f.text = err.msg
+	return f
+}
+
+func statusFrame(body string) Frame {
+	f := newFrame(FRAME_STATUS, body)
+	f.text = body
+	return f
+}
+
+func ackFrame(id string, e HistoryEntry) Frame {
+	f := newFrame(FRAME_ACK, "")
+	f.ID = id
+	f.Seq = e.Seq
+	f.Direction = e.Direction
+	return f
+}
+
+// inputLine formats a message frame received from a JSON client the way the
+// chat program expects it.
+func (f Frame) inputLine() []byte {
+	if f.Callsign == "" {
+		return []byte(f.Body)
+	}
+	return []byte("[" + f.Callsign + "]: " + f.Body)
+}
@@ -0,0 +1,205 @@
+package command_socket
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of entries kept for each radio configuration
+	DEFAULT_HISTORY_SIZE = 1000
+
+	// Default number of entries replayed to a newly connected client
+	DEFAULT_HISTORY_REPLAY = 20
+
+	DIRECTION_IN  = "in"  // Line printed by the chat program
+	DIRECTION_OUT = "out" // Line written to the chat program
+)
+
+// HistoryEntry is a single line that went through the chat program.
+type HistoryEntry struct {
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Direction string    `json:"direction"`
+	Line      string    `json:"line"`
+}
+
+// History keeps the most recent lines for each radio configuration. When it
+// has a directory, every entry is also appended to a file named after the
+// radio parameters, and the files are read back on startup.
+type History struct {
+	dir  string
+	size int
+
+	mu       sync.Mutex
+	channels map[RadioParams]*historyChannel
+}
+
+type historyChannel struct {
+	path    string
+	file    *os.File
+	lines   int
+	entries []HistoryEntry
+	nextSeq uint64
+}
+
+// NewHistory creates a history store that keeps size entries per radio
+// configuration. If dir is empty, the history is only kept in memory.
+func NewHistory(dir string, size int) (*History, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &History{
+		dir:      dir,
+		size:     size,
+		channels: map[RadioParams]*historyChannel{},
+	}, nil
+}
+
+func historyFileName(params RadioParams) string {
+	return fmt.Sprintf("%s_%d_%d_%d.jsonl",
+		strconv.FormatFloat(params.frequency, 'f', -1, 64),
+		params.bandwidth, params.spreadingFactor, params.codingRate)
+}
+
+// channel returns the history for the radio parameters, loading it from
+// disk the first time. The caller must hold h.mu.
+func (h *History) channel(params RadioParams) *historyChannel {
+	if ch, ok := h.channels[params]; ok {
+		return ch
+	}
+
+	ch := &historyChannel{nextSeq: 1}
+	h.channels[params] = ch
+	if h.dir == "" {
+		return ch
+	}
+
+	ch.path = filepath.Join(h.dir, historyFileName(params))
+	if f, err := os.Open(ch.path); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var e HistoryEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				continue
+			}
+			ch.lines++
+			ch.keep(e, h.size)
+		}
+		f.Close()
+		if len(ch.entries) > 0 {
+			ch.nextSeq = ch.entries[len(ch.entries)-1].Seq + 1
+		}
+	}
+
+	f, err := os.OpenFile(ch.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		slog.Warn("Cannot open history file, keeping it in memory", "path", ch.path, "err", err)
+		return ch
+	}
+	ch.file = f
+	return ch
+}
+
+// keep adds the entry to the in-memory window.
+func (ch *historyChannel) keep(e HistoryEntry, size int) {
+	ch.entries = append(ch.entries, e)
+	if len(ch.entries) > size {
+		ch.entries = append(ch.entries[:0:0], ch.entries[len(ch.entries)-size:]...)
+	}
+}
+
+// compact rewrites the file with only the entries still kept in memory.
+func (ch *historyChannel) compact() {
+	tmp := ch.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		slog.Warn("Cannot compact history file", "path", ch.path, "err", err)
+		return
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range ch.entries {
+		enc.Encode(e)
+	}
+	f.Close()
+	ch.file.Close()
+	if err := os.Rename(tmp, ch.path); err != nil {
+		slog.Warn("Cannot compact history file", "path", ch.path, "err", err)
+	}
+	ch.file, err = os.OpenFile(ch.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		slog.Warn("Cannot reopen history file", "path", ch.path, "err", err)
+		ch.file = nil
+	}
+	ch.lines = len(ch.entries)
+}
+
+// Record stores a line and returns the entry.
+func (h *History) Record(params RadioParams, direction string, line string) HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := h.channel(params)
+	e := HistoryEntry{
+		Seq:       ch.nextSeq,
+		Timestamp: time.Now(),
+		Direction: direction,
+		Line:      line,
+	}
+	ch.nextSeq++
+	ch.keep(e, h.size)
+
+	if ch.file != nil {
+		b, _ := json.Marshal(e)
+		if _, err := ch.file.Write(append(b, '\n')); err != nil {
+			slog.Warn("Cannot write history file", "path", ch.path, "err", err)
+		}
+		ch.lines++
+		if ch.lines > 2*h.size {
+			ch.compact()
+		}
+	}
+	return e
+}
+
+// Since returns the entries recorded after the given sequence number. At
+// most limit entries are returned, the most recent ones, unless limit is 0.
+func (h *History) Since(params RadioParams, since uint64, limit int) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := h.channel(params).entries
+	i := len(entries)
+	for i > 0 && entries[i-1].Seq > since {
+		i--
+	}
+	entries = entries[i:]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]HistoryEntry(nil), entries...)
+}
+
+// Close closes the history files.
+func (h *History) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ch := range h.channels {
+		if ch.file != nil {
+			ch.file.Close()
+			ch.file = nil
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package command_socket
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of outgoing messages buffered for each client
+	clientBufferSize = 16
+
+	// Default number of times a crashed chat program is restarted
+	DEFAULT_MAX_RESTARTS = 5
+)
+
+// Hub owns the chat programs started on behalf of the websocket clients.
+// There is at most one running program per radio configuration, and every
+// client that asks for the same configuration is attached to it.
+type Hub struct {
+	// How the chat program is started
+	Command Command
+
+	// How many times in a row a crashed chat program is restarted before
+	// the clients are disconnected
+	MaxRestarts int
+
+	// Lines that went through the chat programs, and how many of them are
+	// replayed to new clients by default
+	History       *History
+	HistoryReplay int
+
+	// How long a radio started through the REST API is kept running after
+	// the last request
+	APILinger time.Duration
+
+	// Who may connect, everyone from pages served by this server if nil
+	Access *AccessControl
+
+	// Whether outgoing messages are tagged and tracked until a peer
+	// acknowledges them, and tagged messages from peers are acknowledged
+	// on behalf of the station with the given callsign. Unacknowledged
+	// messages are sent again up to Retransmits times, every AckTimeout.
+	Acks        bool
+	Callsign    string
+	AckTimeout  time.Duration
+	Retransmits int
+
+	// Fraction of the time each radio may spend transmitting, such as 0.01
+	// for 1%, or 0 for no limit. The time on air of each message is worked
+	// out from the radio parameters.
+	DutyCycle float64
+
+	// Messages per minute each callsign may send on a radio after sending
+	// RateBurst messages in a row, or 0 for no limit
+	RateLimit float64
+	RateBurst int
+
+	// Turns the lines printed by the chat program into events
+	Parser LineParser
+
+	// Number of recent messages the link statistics of each station are
+	// based on
+	LinkWindow int
+
+	// How repeated copies of a received message are handled, by default and
+	// for specific radio parameters
+	Dedup       DedupConfig
+	DedupRadios map[RadioParams]DedupConfig
+
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	radios  map[RadioParams]*Radio
+	leases  map[RadioParams]*lease
+	closing bool
+
+	// Running websocket sessions and radios
+	sessions sync.WaitGroup
+	running  sync.WaitGroup
+
+	// Stations heard with each radio parameters, by callsign. They outlive
+	// the radios.
+	linksMu sync.Mutex
+	links   map[RadioParams]map[string]*link
+
+	// Running or last range test of each radio parameters, and the running
+	// or last sweep
+	rangeMu    sync.Mutex
+	rangeTests map[RadioParams]*rangeTest
+	sweep      *sweep
+}
+
+// Radio is a single running chat program shared by all attached clients.
+// Lines read from its output are broadcast to every client, and writes from
+// the clients are serialized into its input.
+type Radio struct {
+	hub    *Hub
+	params RadioParams
+	log    *slog.Logger
+
+	inputIO  chan []byte
+	outputIO chan []byte
+	diagIO   chan string
+	errIO    chan Error
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// Messages waiting to be written to the chat program
+	tx *txQueue
+
+	// Joins fragmented messages printed by the chat program
+	reassembler *reassembler
+
+	// Messages waiting for an acknowledgement, by their tag
+	deliveryMu sync.Mutex
+	deliveries map[string]*trackedMessage
+
+	// Recently received messages, nil if duplicates are not suppressed
+	dedup *deduplicator
+
+	// Reception metadata waiting for the next message, only used by the
+	// supervisor
+	rx *RXMetadata
+
+	// Closed once the first run of the chat program is known to be up, or
+	// to have failed, in which case startErr is set
+	ready     chan struct{}
+	readyOnce sync.Once
+	startErr  string
+
+	mu      sync.Mutex
+	clients map[*client]bool
+}
+
+type client struct {
+	send chan Frame
+	json bool
+	log  *slog.Logger
+
+	// Whether the client wants the diagnostics of the chat program
+	diagnostics bool
+
+	// Radio the client is attached to, only used by the session's reader
+	radio *Radio
+
+	// Messages of the session waiting in the transmit queue
+	outgoing sync.WaitGroup
+
+	// History replayed before any other frame
+	backlog []Frame
+
+	// Done when the client is kicked, with the close code to send, or when
+	// the session is over
+	kicked     context.Context
+	cancelKick context.CancelFunc
+	kickOnce   sync.Once
+	closeCode  int
+}
+
+// newClient creates a client for the session whose lifetime is ctx.
+func newClient(ctx context.Context, json bool, log *slog.Logger) *client {
+	kicked, cancel := context.WithCancel(ctx)
+	return &client{
+		send:       make(chan Frame, clientBufferSize),
+		json:       json,
+		log:        log,
+		kicked:     kicked,
+		cancelKick: cancel,
+	}
+}
+
+func (c *client) kick(code int) {
+	c.kickOnce.Do(func() {
+		c.closeCode = code
+		c.cancelKick()
+	})
+}
+
+// replay describes which history entries are sent to a new client: the
+// ones after the since cursor, but no more than limit (0 for all of them).
+type replay struct {
+	since uint64
+	limit int
+}
+
+func NewHub(cmd string) *Hub {
+	history, _ := NewHistory("", DEFAULT_HISTORY_SIZE)
+	h := &Hub{
+		Command:       Command{Path: cmd, Args: DEFAULT_ARGS},
+		MaxRestarts:   DEFAULT_MAX_RESTARTS,
+		History:       history,
+		HistoryReplay: DEFAULT_HISTORY_REPLAY,
+		APILinger:     DEFAULT_API_LINGER,
+		AckTimeout:    DEFAULT_ACK_TIMEOUT,
+		Dedup:         DedupConfig{Mode: DEDUP_OFF, Window: DEFAULT_DEDUP_WINDOW},
+		RateBurst:     DEFAULT_RATE_BURST,
+		Parser:        OthernetParser{},
+		LinkWindow:    DEFAULT_LINK_WINDOW,
+		links:         map[RadioParams]map[string]*link{},
+		rangeTests:    map[RadioParams]*rangeTest{},
+		radios:        map[RadioParams]*Radio{},
+		leases:        map[RadioParams]*lease{},
+		upgrader:      upgrader,
+	}
+	h.upgrader.CheckOrigin = func(r *http.Request) bool {
+		return h.Access.checkOrigin(r)
+	}
+	return h
+}
+
+// attach adds the client to the radio running with the given parameters,
+// spawning the chat program if no client is using that configuration yet.
+// On success the session is counted as running, and the caller must call
+// h.sessions.Done once all of its goroutines have exited.
+func (h *Hub) attach(params RadioParams, c *client, rp *replay) *Radio {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.join(params, c, rp)
+	if r != nil {
+		h.sessions.Add(1)
+	}
+	return r
+}
+
+// detach removes the client from the radio and stops the chat program once
+// the last client is gone.
+func (h *Hub) detach(r *Radio, c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leave(r, c)
+}
+
+// join implements attach. It returns nil once the hub is shutting down. The
+// caller must hold h.mu.
+func (h *Hub) join(params RadioParams, c *client, rp *replay) *Radio {
+	if h.closing {
+		return nil
+	}
+	r, ok := h.radios[params]
+	if !ok {
+		r = newRadio(h, params)
+		h.radios[params] = r
+		h.running.Add(2)
+		go func() {
+			defer h.running.Done()
+			r.run()
+		}()
+		go func() {
+			defer h.running.Done()
+			r.schedule()
+		}()
+		r.log.Info("Started radio")
+		r.add(c, rp)
+		r.unicast(c, statusFrame("radio started"))
+	} else {
+		r.log.Debug("Joined running radio")
+		r.add(c, rp)
+		r.unicast(c, statusFrame("joined running radio"))
+	}
+	return r
+}
+
+// leave implements detach and reports whether the radio was stopped. The
+// caller must hold h.mu.
+func (h *Hub) leave(r *Radio, c *client) bool {
+	if r.remove(c) > 0 {
+		return false
+	}
+	h.forget(r)
+	r.stop()
+	return true
+}
+
+// forget removes the radio from the registry. The caller must hold h.mu.
+func (h *Hub) forget(r *Radio) {
+	if h.radios[r.params] == r {
+		delete(h.radios, r.params)
+		r.log.Info("Stopped radio")
+	}
+}
+
+func newRadio(h *Hub, params RadioParams) *Radio {
+	r := &Radio{
+		hub:      h,
+		params:   params,
+		log:      radioLogger(params),
+		inputIO:  make(chan []byte),
+		outputIO: make(chan []byte),
+		diagIO:   make(chan string),
+		errIO:    make(chan Error),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+
+		tx:          newTxQueue(h),
+		reassembler: newReassembler(),
+		deliveries:  map[string]*trackedMessage{},
+		clients:     map[*client]bool{},
+	}
+	if d := h.dedupFor(params); d.Mode != DEDUP_OFF {
+		r.dedup = newDeduplicator(d)
+	}
+	return r
+}
+
+// add attaches the client and queues the requested history for it. Lines
+// are recorded while holding the same lock, so the client sees each line
+// either in the backlog or live, but not both.
+func (r *Radio) add(c *client, rp *replay) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rp != nil {
+		for _, e := range r.hub.History.Since(r.params, rp.since, rp.limit) {
+			c.backlog = append(c.backlog, r.hub.historyFrame(e))
+		}
+	}
+	r.clients[c] = true
+}
+
+func (r *Radio) remove(c *client) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, c)
+	return len(r.clients)
+}
+
+func (r *Radio) stop() {
+	r.stopOnce.Do(func() { close(r.quit) })
+}
+
+// markReady records the outcome of the first run of the chat program. An
+// empty reason means it started successfully.
+func (r *Radio) markReady(reason string) {
+	r.readyOnce.Do(func() {
+		r.startErr = reason
+		close(r.ready)
+	})
+}
+
+// waitReady blocks until the first run of the chat program is up and
+// returns the reason it failed, if it did.
+func (r *Radio) waitReady() string {
+	<-r.ready
+	return r.startErr
+}
+
+// parse returns the event for a line printed by the chat program.
+func (h *Hub) parse(line string) Event {
+	if ev, ok := h.Parser.Parse(line); ok {
+		return ev
+	}
+	return Event{Type: EVENT_STATUS, Text: line}
+}
+
+// receive parses a line printed by the chat program and publishes it without
+// its delivery tag, unless it is a duplicate. Prompts are dropped, and
+// reception metadata is attached to the next message. Acknowledgements,
+// range test probes and their answers are not published, and tagged messages
+// from peers are acknowledged if they arrived complete, including copies,
+// since the sender may have missed the first acknowledgement.
+func (r *Radio) receive(line []byte, complete bool) {
+	ev := r.hub.parse(string(line))
+	switch ev.Type {
+	case EVENT_PROMPT:
+		return
+	case EVENT_RX:
+		r.rx = rxMetadata(ev.Fields)
+		return
+	}
+
+	tag := ""
+	var rx *RXMetadata
+	if ev.Type == EVENT_MESSAGE {
+		rx, r.rx = r.rx, nil
+		r.hub.recordLink(r.params, ev.Callsign, rx)
+		if r.rangeTestMessage(ev.Callsign, ev.Text, rx) {
+			return
+		}
+		if m := ackTagRe.FindStringSubmatch(ev.Text); m != nil {
+			r.acked(m[1], ev.Callsign)
+			return
+		}
+		if m := messageTagRe.FindStringSubmatch(ev.Text); m != nil {
+			tag, ev.Text = m[1], m[2]
+			line = []byte(strings.Replace(string(line), "~m:"+tag+"~", "", 1))
+			if r.hub.Acks && complete && !r.isOwn(tag) {
+				go r.sendAck(tag)
+			}
+		}
+	}
+
+	f := eventFrame(ev, string(line))
+	f.RX = rx
+	if r.dedup != nil && f.Type == FRAME_MESSAGE {
+		if first, dup := r.dedup.check(f.Callsign, f.Body, tag, f.ID); dup {
+			r.log.Debug("Duplicate message dropped", "body", string(line), "repeats", first.repeats)
+			metrics.duplicates.inc()
+			if r.dedup.Mode == DEDUP_COUNT {
+				r.broadcast(repeatFrame(first))
+			}
+			return
+		}
+	}
+	r.publish(line, f)
+}
+
+// publish records a line printed by the chat program and broadcasts it in
+// the frame made from it.
+func (r *Radio) publish(line []byte, f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.hub.History.Record(r.params, DIRECTION_IN, string(line))
+	f.Seq = e.Seq
+	f.Direction = e.Direction
+	for c := range r.clients {
+		c.deliver(f)
+	}
+}
+
+// diagnose sends a diagnostic of the chat program to the clients that want
+// them.
+func (r *Radio) diagnose(line string) {
+	f := diagnosticFrame(line)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.clients {
+		if c.diagnostics {
+			c.deliver(f)
+		}
+	}
+}
+
+func (r *Radio) broadcast(f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.clients {
+		c.deliver(f)
+	}
+}
+
+// unicast sends a frame to a single client if it is still attached.
+func (r *Radio) unicast(c *client, f Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[c] {
+		c.deliver(f)
+	}
+}
+
+// deliver queues the frame without blocking. The caller must hold the
+// radio's lock.
+func (c *client) deliver(f Frame) {
+	if c.send == nil {
+		// Clients without a socket don't receive frames
+		return
+	}
+	select {
+	case c.send <- f:
+	default:
+		c.log.Warn("Client is not keeping up, frame dropped", "type", f.Type)
+	}
+}
+
+// disconnectAll detaches every client, which makes their sockets close with
+// the given close code.
+func (r *Radio) disconnectAll(code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.clients {
+		delete(r.clients, c)
+		c.kick(code)
+	}
+}
+
+// Shutdown stops accepting new clients, disconnects every client with a
+// close frame and stops all chat programs. It returns once all programs have
+// been reaped and the sessions have ended, or with the context's error when
+// its deadline passes first.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+	var radios []*Radio
+	for _, r := range h.radios {
+		radios = append(radios, r)
+	}
+	for params, l := range h.leases {
+		l.timer.Stop()
+		delete(h.leases, params)
+	}
+	h.mu.Unlock()
+
+	h.rangeMu.Lock()
+	if h.sweep != nil {
+		h.sweep.end()
+	}
+	h.rangeMu.Unlock()
+
+	slog.Info("Shutting down", "radios", len(radios))
+	for _, r := range radios {
+		r.broadcast(statusFrame("server is shutting down"))
+		r.disconnectAll(websocket.CloseGoingAway)
+		r.stop()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		h.sessions.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		slog.Info("Shutdown complete")
+		return nil
+	case <-ctx.Done():
+		slog.Warn("Shutdown did not complete in time")
+		return ctx.Err()
+	}
+}
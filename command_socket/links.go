@@ -0,0 +1,223 @@
+package command_socket
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default number of recent messages the link statistics of each callsign
+// are based on
+const DEFAULT_LINK_WINDOW = 50
+
+// CRC status of a received packet
+const (
+	CRC_OK    = "ok"
+	CRC_ERROR = "error"
+)
+
+// RXMetadata describes how a message was received, as printed by the chat
+// program. Values the chat program did not print are left out.
+type RXMetadata struct {
+	RSSI      *float64 `json:"rssi,omitempty"`      // Signal strength in dBm
+	SNR       *float64 `json:"snr,omitempty"`       // Signal to noise ratio in dB
+	FreqError *float64 `json:"freqError,omitempty"` // Frequency error in Hz
+	CRC       string   `json:"crc,omitempty"`       // CRC_OK or CRC_ERROR
+}
+
+// Names the chat program may use for the reception metadata
+var (
+	rssiFields      = []string{"rssi"}
+	snrFields       = []string{"snr"}
+	freqErrorFields = []string{"freqerror", "freq_error", "freqerr", "ferr", "fei"}
+	crcFields       = []string{"crc"}
+)
+
+func lookupField(fields map[string]string, names []string) (string, bool) {
+	for _, name := range names {
+		if v, ok := fields[name]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// rxMetadata picks the link quality values out of the fields of an EVENT_RX
+// event. It returns nil if there are none.
+func rxMetadata(fields map[string]string) *RXMetadata {
+	var rx RXMetadata
+	found := false
+	number := func(names []string) *float64 {
+		v, ok := lookupField(fields, names)
+		if !ok {
+			return nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil
+		}
+		found = true
+		return &f
+	}
+	rx.RSSI = number(rssiFields)
+	rx.SNR = number(snrFields)
+	rx.FreqError = number(freqErrorFields)
+	if v, ok := lookupField(fields, crcFields); ok {
+		switch strings.ToLower(v) {
+		case "ok", "pass", "good", "1", "true":
+			rx.CRC = CRC_OK
+			found = true
+		case "error", "err", "fail", "bad", "0", "false":
+			rx.CRC = CRC_ERROR
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &rx
+}
+
+// Summary describes the values of one metric over the recent messages.
+type Summary struct {
+	Last float64 `json:"last"`
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// LinkStats describes the link to a station, based on the recent messages
+// received from it.
+type LinkStats struct {
+	Callsign  string    `json:"callsign"`
+	Messages  uint64    `json:"messages"` // All messages received
+	LastHeard time.Time `json:"lastHeard"`
+
+	// Statistics over the last messages, up to the hub's LinkWindow
+	Window    int      `json:"window"`
+	RSSI      *Summary `json:"rssi,omitempty"`
+	SNR       *Summary `json:"snr,omitempty"`
+	FreqError *Summary `json:"freqError,omitempty"`
+	CRCErrors int      `json:"crcErrors"`
+}
+
+// link keeps the recent messages received from a station.
+type link struct {
+	messages  uint64
+	lastHeard time.Time
+	recent    []RXMetadata // Oldest first
+}
+
+// recordLink adds a message received from the callsign to its link
+// statistics. The metadata is nil if the chat program did not print any.
+func (h *Hub) recordLink(params RadioParams, callsign string, rx *RXMetadata) {
+	if callsign == "" {
+		return
+	}
+	h.linksMu.Lock()
+	defer h.linksMu.Unlock()
+	links := h.links[params]
+	if links == nil {
+		links = map[string]*link{}
+		h.links[params] = links
+	}
+	l := links[callsign]
+	if l == nil {
+		l = &link{}
+		links[callsign] = l
+	}
+	l.messages++
+	l.lastHeard = time.Now()
+	if rx == nil {
+		rx = &RXMetadata{}
+	}
+	l.recent = append(l.recent, *rx)
+	if over := len(l.recent) - h.LinkWindow; over > 0 {
+		l.recent = l.recent[over:]
+	}
+}
+
+// summarizeValues returns the summary of the values, oldest first, or nil
+// if there are none.
+func summarizeValues(values []float64) *Summary {
+	if len(values) == 0 {
+		return nil
+	}
+	s := Summary{Last: values[len(values)-1], Min: values[0], Max: values[0]}
+	for _, v := range values {
+		s.Mean += v
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+	}
+	s.Mean /= float64(len(values))
+	return &s
+}
+
+// summarize returns the summary of the values picked by get, or nil if no
+// message has one.
+func summarize(recent []RXMetadata, get func(RXMetadata) *float64) *Summary {
+	var values []float64
+	for _, rx := range recent {
+		if v := get(rx); v != nil {
+			values = append(values, *v)
+		}
+	}
+	return summarizeValues(values)
+}
+
+// linkStats returns the statistics of the stations heard with the radio
+// parameters, by callsign.
+func (h *Hub) linkStats(params RadioParams) []LinkStats {
+	h.linksMu.Lock()
+	defer h.linksMu.Unlock()
+	stats := []LinkStats{}
+	for callsign, l := range h.links[params] {
+		s := LinkStats{
+			Callsign:  callsign,
+			Messages:  l.messages,
+			LastHeard: l.lastHeard,
+			Window:    len(l.recent),
+			RSSI:      summarize(l.recent, func(rx RXMetadata) *float64 { return rx.RSSI }),
+			SNR:       summarize(l.recent, func(rx RXMetadata) *float64 { return rx.SNR }),
+			FreqError: summarize(l.recent, func(rx RXMetadata) *float64 { return rx.FreqError }),
+		}
+		for _, rx := range l.recent {
+			if rx.CRC == CRC_ERROR {
+				s.CRCErrors++
+			}
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Callsign < stats[j].Callsign })
+	return stats
+}
+
+// ServeLinks implements the /api/links endpoint, which returns the link
+// statistics of the stations heard with the radio parameters in the query
+// string.
+func (h *Hub) ServeLinks(w http.ResponseWriter, r *http.Request) {
+	if !h.Access.authorize(w, r, true) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	params, err := defaultRadioParams.withQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid radio parameters",
+			"fields": err,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"params": params,
+		"links":  h.linkStats(params),
+	})
+}
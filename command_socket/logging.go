@@ -0,0 +1,57 @@
+package command_socket
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Log output formats
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+)
+
+// Default log level. Message bodies are only logged at the debug level.
+const DEFAULT_LOG_LEVEL = "info"
+
+var sessionCounter uint64
+
+// NewLogger creates a logger that writes lines at or above the given level
+// ("debug", "info", "warn" or "error") in the given format. Install it with
+// slog.SetDefault, which also sends the standard log package through it.
+func NewLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case LOG_FORMAT_LOGFMT:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+// newSessionLogger returns a logger for a websocket session, tagged with an
+// id that is unique within the process.
+func newSessionLogger() *slog.Logger {
+	id := strconv.FormatUint(atomic.AddUint64(&sessionCounter, 1), 10)
+	return slog.With("session", id)
+}
+
+// radioID identifies a radio configuration in the logs, for example
+// "868_400_12_5".
+func radioID(params RadioParams) string {
+	return strings.TrimSuffix(historyFileName(params), ".jsonl")
+}
+
+// radioLogger returns a logger tagged with the radio parameters.
+func radioLogger(params RadioParams) *slog.Logger {
+	return slog.With("radio", radioID(params))
+}
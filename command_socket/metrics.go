@@ -0,0 +1,166 @@
+package command_socket
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are kept for the whole process and served in the Prometheus text
+// format by ServeMetrics.
+
+type counter struct {
+	v uint64
+}
+
+func (c *counter) inc()          { atomic.AddUint64(&c.v, 1) }
+func (c *counter) value() uint64 { return atomic.LoadUint64(&c.v) }
+
+type gauge struct {
+	v int64
+}
+
+func (g *gauge) add(n int64)  { atomic.AddInt64(&g.v, n) }
+func (g *gauge) value() int64 { return atomic.LoadInt64(&g.v) }
+
+// histogram counts observations in cumulative buckets with the given upper
+// bounds.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+var metrics = struct {
+	sessions       gauge
+	txQueue        gauge
+	spawned        counter
+	restarts       counter
+	messagesIn     counter
+	messagesOut    counter
+	garbled        counter
+	duplicates     counter
+	diagnostics    counter
+	stdinErrors    counter
+	socketErrors   counter
+	pingFailures   counter
+	writeLatency   *histogram
+	messageSizeIn  *histogram
+	messageSizeOut *histogram
+}{
+	writeLatency:   newHistogram(0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10),
+	messageSizeIn:  newHistogram(8, 16, 32, 64, 128, 256, 512, 1024, 4096),
+	messageSizeOut: newHistogram(8, 16, 32, 64, 128, 256, 512, 1024, 4096),
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSeries writes the series of a histogram, with labels such as
+// `direction="in"` added to each of them.
+func (h *histogram) writeSeries(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	m := &metrics
+
+	writeHeader(w, "wschat_sessions", "gauge", "Number of connected websocket clients.")
+	fmt.Fprintf(w, "wschat_sessions %d\n", m.sessions.value())
+
+	writeHeader(w, "wschat_transmit_queue", "gauge", "Messages waiting to be written to the chat programs.")
+	fmt.Fprintf(w, "wschat_transmit_queue %d\n", m.txQueue.value())
+
+	writeHeader(w, "wschat_processes_spawned_total", "counter", "Chat programs started.")
+	fmt.Fprintf(w, "wschat_processes_spawned_total %d\n", m.spawned.value())
+
+	writeHeader(w, "wschat_process_restarts_total", "counter", "Chat programs restarted after exiting on their own.")
+	fmt.Fprintf(w, "wschat_process_restarts_total %d\n", m.restarts.value())
+
+	writeHeader(w, "wschat_messages_total", "counter", "Lines read from (in) and written to (out) the chat programs.")
+	fmt.Fprintf(w, "wschat_messages_total{direction=\"in\"} %d\n", m.messagesIn.value())
+	fmt.Fprintf(w, "wschat_messages_total{direction=\"out\"} %d\n", m.messagesOut.value())
+
+	writeHeader(w, "wschat_garbled_total", "counter", "Lines from the chat programs that were not valid UTF-8.")
+	fmt.Fprintf(w, "wschat_garbled_total %d\n", m.garbled.value())
+
+	writeHeader(w, "wschat_diagnostics_total", "counter", "Lines written by the chat programs to their standard error.")
+	fmt.Fprintf(w, "wschat_diagnostics_total %d\n", m.diagnostics.value())
+
+	writeHeader(w, "wschat_duplicates_total", "counter", "Received messages dropped as copies of an earlier one.")
+	fmt.Fprintf(w, "wschat_duplicates_total %d\n", m.duplicates.value())
+
+	writeHeader(w, "wschat_write_errors_total", "counter", "Failed writes to the chat programs and to websocket clients.")
+	fmt.Fprintf(w, "wschat_write_errors_total{target=\"stdin\"} %d\n", m.stdinErrors.value())
+	fmt.Fprintf(w, "wschat_write_errors_total{target=\"socket\"} %d\n", m.socketErrors.value())
+
+	writeHeader(w, "wschat_ping_failures_total", "counter", "Pings that could not be sent to websocket clients.")
+	fmt.Fprintf(w, "wschat_ping_failures_total %d\n", m.pingFailures.value())
+
+	writeHeader(w, "wschat_socket_write_seconds", "histogram", "Time taken to write a frame to a websocket client.")
+	m.writeLatency.writeSeries(w, "wschat_socket_write_seconds", "")
+
+	writeHeader(w, "wschat_message_size_bytes", "histogram", "Size of the lines read from and written to the chat programs.")
+	m.messageSizeIn.writeSeries(w, "wschat_message_size_bytes", `direction="in"`)
+	m.messageSizeOut.writeSeries(w, "wschat_message_size_bytes", `direction="out"`)
+}
+
+// observeWrite records how long a websocket write took and whether it failed.
+func observeWrite(start time.Time, err error) {
+	metrics.writeLatency.observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.socketErrors.inc()
+	}
+}
+
+// ServeMetrics serves the metrics in the Prometheus text format.
+func (h *Hub) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.Access.authorize(w, r, true) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
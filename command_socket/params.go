@@ -1,5 +1,15 @@
 package command_socket
 
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type RadioParams struct {
 	frequency       float64
 	spreadingFactor int
@@ -7,11 +17,171 @@ type RadioParams struct {
 	codingRate      int
 }
 
+// JSON form of RadioParams, using the same names as the query parameters
+type radioParamsJSON struct {
+	Frequency       float64 `json:"frequency"`
+	Bandwidth       int     `json:"bandwidth"`
+	SpreadingFactor int     `json:"spreadingFactor"`
+	CodingRate      int     `json:"codingRate"`
+}
+
+func (p RadioParams) String() string {
+	return fmt.Sprintf("%v MHz, BW %d kHz, SF %d, CR 4/%d",
+		p.frequency, p.bandwidth, p.spreadingFactor, p.codingRate)
+}
+
+func (p RadioParams) MarshalJSON() ([]byte, error) {
+	return json.Marshal(radioParamsJSON{
+		Frequency:       p.frequency,
+		Bandwidth:       p.bandwidth,
+		SpreadingFactor: p.spreadingFactor,
+		CodingRate:      p.codingRate,
+	})
+}
+
+// UnmarshalJSON only overwrites the fields present in the input, so that
+// a partial object can be applied on top of the current parameters.
+func (p *RadioParams) UnmarshalJSON(b []byte) error {
+	j := radioParamsJSON{
+		Frequency:       p.frequency,
+		Bandwidth:       p.bandwidth,
+		SpreadingFactor: p.spreadingFactor,
+		CodingRate:      p.codingRate,
+	}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*p = RadioParams{
+		frequency:       j.Frequency,
+		bandwidth:       j.Bandwidth,
+		spreadingFactor: j.SpreadingFactor,
+		codingRate:      j.CodingRate,
+	}
+	return nil
+}
+
+// FieldError describes a single invalid radio parameter.
+type FieldError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists all invalid radio parameters.
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, f := range v {
+		msgs[i] = f.Field + " " + f.Reason
+	}
+	return "invalid parameters: " + strings.Join(msgs, ", ")
+}
+
+// withQuery returns a copy of the parameters with the values present in the
+// query string applied on top. Values that cannot be parsed, or that fail
+// validation, are reported as a ValidationError.
+func (p RadioParams) withQuery(q url.Values) (RadioParams, error) {
+	var errs ValidationError
+	parseErr := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, FieldError{field, q.Get(field), "must be a number"})
+		}
+	}
+
+	var err error
+	p.frequency, err = parseFloatParam(q, "frequency", p.frequency)
+	parseErr("frequency", err)
+	p.bandwidth, err = parseIntParam(q, "bandwidth", p.bandwidth)
+	parseErr("bandwidth", err)
+	p.spreadingFactor, err = parseIntParam(q, "spreadingFactor", p.spreadingFactor)
+	parseErr("spreadingFactor", err)
+	p.codingRate, err = parseIntParam(q, "codingRate", p.codingRate)
+	parseErr("codingRate", err)
+
+	// Report the remaining fields that parsed but are out of range
+	if v, ok := p.Validate().(ValidationError); ok {
+		for _, f := range v {
+			if !errs.has(f.Field) {
+				errs = append(errs, f)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return p, errs
+	}
+	return p, nil
+}
+
+func (v ValidationError) has(field string) bool {
+	for _, f := range v {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the chat program can be configured with these
+// parameters. It returns a ValidationError listing every invalid field.
+func (p RadioParams) Validate() error {
+	var errs ValidationError
+	if math.IsNaN(p.frequency) || math.IsInf(p.frequency, 0) ||
+		p.frequency < MIN_FREQUENCY || p.frequency > MAX_FREQUENCY {
+		errs = append(errs, FieldError{
+			Field:  "frequency",
+			Value:  strconv.FormatFloat(p.frequency, 'f', -1, 64),
+			Reason: fmt.Sprintf("must be between %v and %v MHz", MIN_FREQUENCY, MAX_FREQUENCY),
+		})
+	}
+	checkMember := func(field string, value int, table map[int]int) {
+		if _, ok := table[value]; !ok {
+			errs = append(errs, FieldError{
+				Field:  field,
+				Value:  strconv.Itoa(value),
+				Reason: "must be one of " + tableKeys(table),
+			})
+		}
+	}
+	checkMember("bandwidth", p.bandwidth, Bandwidths)
+	checkMember("spreadingFactor", p.spreadingFactor, SpreadingFactors)
+	checkMember("codingRate", p.codingRate, CodingRates)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// tableKeys lists the keys of a translation table in ascending order.
+func tableKeys(table map[int]int) string {
+	keys := make([]int, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = strconv.Itoa(k)
+	}
+	return strings.Join(s, ", ")
+}
+
 const DEFAULT_FREQUENCY = 1000.0
 const DEFAULT_SPREADING_FACTOR = 12
 const DEFAULT_BANDWIDTH = 400
 const DEFAULT_CODING_RATE = 5
 
+// Frequency range supported by the radio, in MHz
+const MIN_FREQUENCY = 40.0
+const MAX_FREQUENCY = 6000.0
+
+var defaultRadioParams = RadioParams{
+	frequency:       DEFAULT_FREQUENCY,
+	bandwidth:       DEFAULT_BANDWIDTH,
+	spreadingFactor: DEFAULT_SPREADING_FACTOR,
+	codingRate:      DEFAULT_CODING_RATE,
+}
+
 var Bandwidths = map[int]int{
 	200:  52,
 	400:  38,
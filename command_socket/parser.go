@@ -0,0 +1,146 @@
+package command_socket
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Types of events a LineParser can find in the chat program's output
+const (
+	EVENT_MESSAGE = "message" // Chat message, sent to clients as a message frame
+	EVENT_STATUS  = "status"  // Status line of the chat program, sent as a system frame
+	EVENT_RX      = "rx"      // Reception metadata, attached to the next message
+	EVENT_PROMPT  = "prompt"  // Input prompt, not sent to clients
+)
+
+// Event is the meaning of a line printed by the chat program.
+type Event struct {
+	Type     string
+	Callsign string
+	Text     string
+
+	// Other values found in the line, such as "rssi" and "snr" for EVENT_RX
+	Fields map[string]string
+}
+
+// LineParser turns the lines printed by the chat program into events.
+type LineParser interface {
+	// Parse returns the event for a line, or false if the parser does not
+	// recognize it.
+	Parse(line string) (Event, bool)
+}
+
+// ParserChain tries each parser in turn. Lines that none of them recognize
+// are status lines.
+type ParserChain []LineParser
+
+func (pc ParserChain) Parse(line string) (Event, bool) {
+	for _, p := range pc {
+		if ev, ok := p.Parse(line); ok {
+			return ev, true
+		}
+	}
+	return Event{Type: EVENT_STATUS, Text: line}, true
+}
+
+var (
+	// Reception metadata such as "RX: rssi=-87 snr=7.5 crc=ok", or "RSSI:
+	// -87 dBm, SNR: 7.5 dB", made only of key and value fields
+	rxLineRe  = regexp.MustCompile(`(?i)^(?:rx:?\s*)?((?:[a-z_]+\s*[=:]\s*(?:-?[0-9.]+\s*(?:dbm|db|hz)?|[a-z]+)[\s,]*)+)$`)
+	rxFieldRe = regexp.MustCompile(`(?i)([a-z_]+)\s*[=:]\s*(-?[0-9.]+|[a-z]+)`)
+)
+
+// OthernetParser understands the output of the Othernet chat program. Each
+// line may start with a ">" prompt, and a line with only the prompt is the
+// prompt for the next message. Chat messages have the "[callsign]: text"
+// form, and reception metadata is printed as key=value or key: value fields
+// that include the RSSI or SNR. Everything else is a status line.
+type OthernetParser struct{}
+
+func (OthernetParser) Parse(line string) (Event, bool) {
+	s := strings.TrimPrefix(line, ">")
+	if strings.TrimSpace(s) == "" {
+		return Event{Type: EVENT_PROMPT}, true
+	}
+	if m := callsignRe.FindStringSubmatch(s); m != nil {
+		return Event{Type: EVENT_MESSAGE, Callsign: m[1], Text: strings.TrimSpace(m[2])}, true
+	}
+	if m := rxLineRe.FindStringSubmatch(strings.TrimSpace(s)); m != nil {
+		fields := map[string]string{}
+		for _, f := range rxFieldRe.FindAllStringSubmatch(m[1], -1) {
+			fields[strings.ToLower(f[1])] = f[2]
+		}
+		if fields["rssi"] != "" || fields["snr"] != "" {
+			return Event{Type: EVENT_RX, Fields: fields}, true
+		}
+	}
+	return Event{Type: EVENT_STATUS, Text: s}, true
+}
+
+// RegexParser recognizes the lines that match a regular expression as
+// events of one type. The callsign and text named groups fill the event's
+// Callsign and Text, other named groups end up in its Fields. Without a text
+// group, the whole line is the text.
+type RegexParser struct {
+	Type string
+	Re   *regexp.Regexp
+}
+
+// ParseParserRule creates a RegexParser from a rule in the "type:regexp"
+// form, such as "message:^<(?P<callsign>\w+)> (?P<text>.*)$".
+func ParseParserRule(rule string) (*RegexParser, error) {
+	i := strings.Index(rule, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("parser rule must have the type:regexp form")
+	}
+	typ := rule[:i]
+	switch typ {
+	case EVENT_MESSAGE, EVENT_STATUS, EVENT_RX, EVENT_PROMPT:
+	default:
+		return nil, fmt.Errorf("parser type must be %s, %s, %s or %s",
+			EVENT_MESSAGE, EVENT_STATUS, EVENT_RX, EVENT_PROMPT)
+	}
+	re, err := regexp.Compile(rule[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	return &RegexParser{Type: typ, Re: re}, nil
+}
+
+func (p *RegexParser) Parse(line string) (Event, bool) {
+	m := p.Re.FindStringSubmatch(line)
+	if m == nil {
+		return Event{}, false
+	}
+	ev := Event{Type: p.Type, Text: line}
+	for i, name := range p.Re.SubexpNames() {
+		switch name {
+		case "":
+		case "callsign":
+			ev.Callsign = m[i]
+		case "text":
+			ev.Text = strings.TrimSpace(m[i])
+		default:
+			if ev.Fields == nil {
+				ev.Fields = map[string]string{}
+			}
+			ev.Fields[name] = m[i]
+		}
+	}
+	return ev, true
+}
+
+// eventFrame returns the frame for a message or status event. Plain text
+// clients get the line as it was printed.
+func eventFrame(ev Event, line string) Frame {
+	if ev.Type == EVENT_MESSAGE {
+		f := newFrame(FRAME_MESSAGE, ev.Text)
+		f.Callsign = ev.Callsign
+		f.text = line
+		return f
+	}
+	f := newFrame(FRAME_SYSTEM, ev.Text)
+	f.text = line
+	return f
+}
@@ -0,0 +1,636 @@
+package command_socket
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Range test modes
+const (
+	RANGE_TEST_PROBE   = "probe"   // Send probes, and answer the probes of peers
+	RANGE_TEST_RESPOND = "respond" // Only answer the probes of peers
+)
+
+const (
+	// Default time between two probes
+	DEFAULT_PROBE_INTERVAL = 10 * time.Second
+
+	// Default time to wait for the answer to a probe before counting it as
+	// lost
+	DEFAULT_PONG_TIMEOUT = 30 * time.Second
+)
+
+// States of a probe
+const (
+	PROBE_PENDING  = "pending"
+	PROBE_ANSWERED = "answered"
+	PROBE_LOST     = "lost"
+)
+
+// Probes have the "~ping:test.seq~" text, where test is the three digit id
+// of the range test and seq counts the probes from 1. Peers answer with
+// "~pong:test.seq:rssi:snr~", giving how they received the probe if they
+// know it.
+var (
+	pingTagRe = regexp.MustCompile(`^~ping:([0-9a-z]{3})\.([0-9]+)~$`)
+	pongTagRe = regexp.MustCompile(`^~pong:([0-9a-z]{3})\.([0-9]+):(-?[0-9.]*):(-?[0-9.]*)~$`)
+)
+
+// rangeTestRequest is the body of POST /api/rangetest
+type rangeTestRequest struct {
+	Mode     string `json:"mode"`
+	Callsign string `json:"callsign"`
+	Interval string `json:"interval"`
+	Count    int    `json:"count"`
+	Timeout  string `json:"timeout"`
+	Delay    string `json:"delay,omitempty"`
+}
+
+// RangeTestConfig describes a range test.
+type RangeTestConfig struct {
+	Mode     string
+	Callsign string
+
+	// Time between probes, how many to send (0 until the test is stopped),
+	// and how long to wait for each answer
+	Interval time.Duration
+	Count    int
+	Timeout  time.Duration
+
+	// Time to wait before the first probe, so that peers can get ready
+	Delay time.Duration
+}
+
+func (c RangeTestConfig) MarshalJSON() ([]byte, error) {
+	r := rangeTestRequest{
+		Mode:     c.Mode,
+		Callsign: c.Callsign,
+		Interval: c.Interval.String(),
+		Count:    c.Count,
+		Timeout:  c.Timeout.String(),
+	}
+	if c.Delay > 0 {
+		r.Delay = c.Delay.String()
+	}
+	return json.Marshal(r)
+}
+
+// ProbeResult describes one probe and its answer.
+type ProbeResult struct {
+	Seq   int       `json:"seq"`
+	Sent  time.Time `json:"sent"`
+	State string    `json:"state"`
+
+	// Station that answered first, the round trip time in seconds, how the
+	// answer was received here, and how the probe was received by the peer
+	Responder string      `json:"responder,omitempty"`
+	RTT       *float64    `json:"rtt,omitempty"`
+	RX        *RXMetadata `json:"rx,omitempty"`
+	RemoteRX  *RXMetadata `json:"remoteRx,omitempty"`
+}
+
+// RangeTestStats summarizes the probes of a range test. The loss is the
+// fraction of the probes that were lost, out of those that were answered or
+// lost. Heard counts the probes of peers that were answered.
+type RangeTestStats struct {
+	Sent       int      `json:"sent"`
+	Answered   int      `json:"answered"`
+	Lost       int      `json:"lost"`
+	Heard      int      `json:"heard"`
+	Loss       float64  `json:"loss"`
+	RTT        *Summary `json:"rtt,omitempty"`
+	RSSI       *Summary `json:"rssi,omitempty"`
+	SNR        *Summary `json:"snr,omitempty"`
+	RemoteRSSI *Summary `json:"remoteRssi,omitempty"`
+	RemoteSNR  *Summary `json:"remoteSnr,omitempty"`
+}
+
+// RangeTestReport is the outcome of a range test so far.
+type RangeTestReport struct {
+	ID       string          `json:"id"`
+	Params   RadioParams     `json:"params"`
+	Config   RangeTestConfig `json:"config"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Stats    RangeTestStats  `json:"stats"`
+	Probes   []ProbeResult   `json:"probes"`
+}
+
+// rangeTest is a range test running on a radio, or the last one that ran.
+type rangeTest struct {
+	id      string
+	params  RadioParams
+	config  RangeTestConfig
+	started time.Time
+
+	// Closed to end the test early, once it is over, and once the radio it
+	// kept running has been released, and stopped if nobody else uses it
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	released chan struct{}
+
+	mu       sync.Mutex
+	probes   []ProbeResult // By seq, from 1
+	heard    int
+	finished time.Time
+}
+
+func (t *rangeTest) end() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// running reports whether the test is still going on.
+func (t *rangeTest) running() bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// sent records a probe as it is queued for the chat program, so that an
+// answer that arrives before the queue hands it over is recognized.
+func (t *rangeTest) sent(seq int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probes = append(t.probes, ProbeResult{Seq: seq, Sent: time.Now(), State: PROBE_PENDING})
+}
+
+// lost marks a probe that could not be sent as lost, unless it was answered
+// anyway.
+func (t *rangeTest) lost(seq int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p := &t.probes[seq-1]; p.State == PROBE_PENDING {
+		p.State = PROBE_LOST
+	}
+}
+
+// answered records the first answer to a probe. It returns false if the
+// probe is unknown or was already answered or lost.
+func (t *rangeTest) answered(seq int, responder string, rx, remote *RXMetadata) (ProbeResult, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq < 1 || seq > len(t.probes) || t.probes[seq-1].State != PROBE_PENDING {
+		return ProbeResult{}, false
+	}
+	p := &t.probes[seq-1]
+	rtt := time.Since(p.Sent).Seconds()
+	p.State = PROBE_ANSWERED
+	p.Responder = responder
+	p.RTT = &rtt
+	p.RX = rx
+	p.RemoteRX = remote
+	return *p, true
+}
+
+// expire marks the probes whose answer is overdue as lost, and returns them.
+func (t *rangeTest) expire(now time.Time) []ProbeResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var lost []ProbeResult
+	for i := range t.probes {
+		p := &t.probes[i]
+		if p.State == PROBE_PENDING && now.Sub(p.Sent) >= t.config.Timeout {
+			p.State = PROBE_LOST
+			lost = append(lost, *p)
+		}
+	}
+	return lost
+}
+
+// pending reports whether some probes are still waiting for an answer.
+func (t *rangeTest) pending() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.probes {
+		if p.State == PROBE_PENDING {
+			return true
+		}
+	}
+	return false
+}
+
+// probeLine returns the line of a probe sent by the callsign.
+func probeLine(callsign string, id string, seq int) string {
+	return fmt.Sprintf("[%s]: ~ping:%s.%d~", callsign, id, seq)
+}
+
+// stats summarizes the probes. The caller must hold t.mu.
+func (t *rangeTest) stats() RangeTestStats {
+	s := RangeTestStats{Heard: t.heard}
+	var rtt []float64
+	var rx, remote []RXMetadata
+	for _, p := range t.probes {
+		s.Sent++
+		switch p.State {
+		case PROBE_ANSWERED:
+			s.Answered++
+			rtt = append(rtt, *p.RTT)
+			if p.RX != nil {
+				rx = append(rx, *p.RX)
+			}
+			if p.RemoteRX != nil {
+				remote = append(remote, *p.RemoteRX)
+			}
+		case PROBE_LOST:
+			s.Lost++
+		}
+	}
+	if s.Answered+s.Lost > 0 {
+		s.Loss = float64(s.Lost) / float64(s.Answered+s.Lost)
+	}
+	s.RTT = summarizeValues(rtt)
+	s.RSSI = summarize(rx, func(rx RXMetadata) *float64 { return rx.RSSI })
+	s.SNR = summarize(rx, func(rx RXMetadata) *float64 { return rx.SNR })
+	s.RemoteRSSI = summarize(remote, func(rx RXMetadata) *float64 { return rx.RSSI })
+	s.RemoteSNR = summarize(remote, func(rx RXMetadata) *float64 { return rx.SNR })
+	return s
+}
+
+func (t *rangeTest) report() RangeTestReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := RangeTestReport{
+		ID:      t.id,
+		Params:  t.params,
+		Config:  t.config,
+		Started: t.started,
+		Stats:   t.stats(),
+		Probes:  append([]ProbeResult{}, t.probes...),
+	}
+	if !t.finished.IsZero() {
+		finished := t.finished
+		r.Finished = &finished
+	}
+	return r
+}
+
+// rangeTestFrame reports a range test event, with the probe it is about and
+// the statistics so far.
+func (t *rangeTest) frame(event string, p *ProbeResult) Frame {
+	f := newFrame(FRAME_RANGE_TEST, event)
+	f.ID = t.id
+	f.Probe = p
+	t.mu.Lock()
+	stats := t.stats()
+	t.mu.Unlock()
+	f.Stats = &stats
+
+	switch {
+	case event == "started":
+		f.text = fmt.Sprintf("Range test %s started", t.id)
+	case p == nil:
+		f.text = fmt.Sprintf("Range test %s %s: %d of %d probes answered",
+			t.id, event, stats.Answered, stats.Sent)
+	case p.State == PROBE_ANSWERED:
+		f.text = fmt.Sprintf("Range test %s: probe %d answered by %s in %.1fs%s",
+			t.id, p.Seq, p.Responder, *p.RTT, formatRX(p.RX))
+	case p.State == PROBE_LOST:
+		f.text = fmt.Sprintf("Range test %s: probe %d lost", t.id, p.Seq)
+	}
+	return f
+}
+
+func formatRX(rx *RXMetadata) string {
+	if rx == nil || rx.RSSI == nil {
+		return ""
+	}
+	s := fmt.Sprintf(", RSSI %v dBm", *rx.RSSI)
+	if rx.SNR != nil {
+		s += fmt.Sprintf(", SNR %v dB", *rx.SNR)
+	}
+	return s
+}
+
+// rangeTestFor returns the range test running with the radio parameters.
+func (h *Hub) rangeTestFor(params RadioParams) *rangeTest {
+	h.rangeMu.Lock()
+	defer h.rangeMu.Unlock()
+	if t := h.rangeTests[params]; t != nil && t.running() {
+		return t
+	}
+	return nil
+}
+
+// startRangeTest starts a range test with the radio parameters, starting the
+// radio if needed and keeping it running until the test is over. It fails
+// with UNAVAILABLE if the server is shutting down.
+func (h *Hub) startRangeTest(params RadioParams, config RangeTestConfig) (*rangeTest, error) {
+	h.rangeMu.Lock()
+	defer h.rangeMu.Unlock()
+	if t := h.rangeTests[params]; t != nil && t.running() {
+		return nil, fmt.Errorf("range test %s is already running", t.id)
+	}
+
+	t := &rangeTest{
+		id:       newFragmentID(),
+		params:   params,
+		config:   config,
+		started:  time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	c := newClient(context.Background(), false, slog.With("rangetest", t.id))
+	c.send = nil
+	h.mu.Lock()
+	r := h.join(params, c, nil)
+	if r != nil {
+		h.running.Add(1)
+	}
+	h.mu.Unlock()
+	if r == nil {
+		return nil, UNAVAILABLE
+	}
+	h.rangeTests[params] = t
+
+	go func() {
+		defer h.running.Done()
+		defer close(t.released)
+		r.runRangeTest(t)
+		h.mu.Lock()
+		stopped := h.leave(r, c)
+		h.mu.Unlock()
+		if stopped {
+			<-r.done
+		}
+	}()
+	return t, nil
+}
+
+// runRangeTest sends the probes of the test and reports the answers until
+// the test is over.
+func (r *Radio) runRangeTest(t *rangeTest) {
+	r.log.Info("Range test started", "id", t.id, "mode", t.config.Mode)
+	r.broadcast(t.frame("started", nil))
+	defer func() {
+		t.mu.Lock()
+		t.finished = time.Now()
+		t.mu.Unlock()
+		close(t.done)
+		r.log.Info("Range test finished", "id", t.id)
+		r.broadcast(t.frame("finished", nil))
+	}()
+
+	if t.config.Mode == RANGE_TEST_RESPOND {
+		select {
+		case <-t.stop:
+		case <-r.done:
+		}
+		return
+	}
+
+	if t.config.Delay > 0 {
+		select {
+		case <-time.After(t.config.Delay):
+		case <-t.stop:
+			return
+		case <-r.done:
+			return
+		}
+	}
+
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	seq := 0
+	for {
+		if t.config.Count == 0 || seq < t.config.Count {
+			seq++
+			line := probeLine(t.config.Callsign, t.id, seq)
+			t.sent(seq)
+			if err := r.transmit([]byte(line), false, t.stop, nil); err != nil {
+				t.lost(seq)
+				return
+			}
+			r.log.Debug("Probe sent", "id", t.id, "seq", seq)
+		} else if !t.pending() {
+			return
+		}
+
+		select {
+		case now := <-ticker.C:
+			for _, p := range t.expire(now) {
+				p := p
+				r.broadcast(t.frame("lost", &p))
+			}
+		case <-t.stop:
+			return
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// answerProbe answers a probe from a peer on behalf of the range test,
+// telling the peer how the probe was received.
+func (r *Radio) answerProbe(t *rangeTest, test string, seq string, rx *RXMetadata) {
+	rssi, snr := "", ""
+	if rx != nil && rx.RSSI != nil {
+		rssi = strconv.FormatFloat(*rx.RSSI, 'f', -1, 64)
+	}
+	if rx != nil && rx.SNR != nil {
+		snr = strconv.FormatFloat(*rx.SNR, 'f', -1, 64)
+	}
+	line := fmt.Sprintf("[%s]: ~pong:%s.%s:%s:%s~", t.config.Callsign, test, seq, rssi, snr)
+	r.transmit([]byte(line), false, t.stop, nil)
+}
+
+// rangeTestMessage handles the probes and answers among the received
+// messages, and reports whether the text was one.
+func (r *Radio) rangeTestMessage(callsign string, text string, rx *RXMetadata) bool {
+	if m := pingTagRe.FindStringSubmatch(text); m != nil {
+		if t := r.hub.rangeTestFor(r.params); t != nil && m[1] != t.id {
+			t.mu.Lock()
+			t.heard++
+			t.mu.Unlock()
+			go r.answerProbe(t, m[1], m[2], rx)
+		}
+		return true
+	}
+	m := pongTagRe.FindStringSubmatch(text)
+	if m == nil {
+		return false
+	}
+	t := r.hub.rangeTestFor(r.params)
+	if t == nil || m[1] != t.id {
+		return true
+	}
+	seq, _ := strconv.Atoi(m[2])
+	var remote *RXMetadata
+	if m[3] != "" || m[4] != "" {
+		remote = rxMetadata(map[string]string{"rssi": m[3], "snr": m[4]})
+	}
+	if p, ok := t.answered(seq, callsign, rx, remote); ok {
+		r.broadcast(t.frame("answered", &p))
+	}
+	return true
+}
+
+// stopRangeTest ends the range test running with the radio parameters and
+// waits for it to finish. It returns the last test, or nil if there was
+// none.
+func (h *Hub) stopRangeTest(params RadioParams) *rangeTest {
+	h.rangeMu.Lock()
+	t := h.rangeTests[params]
+	h.rangeMu.Unlock()
+	if t != nil {
+		t.end()
+		<-t.done
+	}
+	return t
+}
+
+// writeCSV writes the probes of the report as CSV, one per line.
+func (rep RangeTestReport) writeCSV(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rangetest-%s.csv"`, rep.ID))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "sent", "state", "responder", "rtt", "rssi", "snr", "remote_rssi", "remote_snr"})
+	number := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	for _, p := range rep.Probes {
+		var rx, remote RXMetadata
+		if p.RX != nil {
+			rx = *p.RX
+		}
+		if p.RemoteRX != nil {
+			remote = *p.RemoteRX
+		}
+		cw.Write([]string{
+			strconv.Itoa(p.Seq), p.Sent.Format(time.RFC3339Nano), p.State, p.Responder,
+			number(p.RTT), number(rx.RSSI), number(rx.SNR), number(remote.RSSI), number(remote.SNR),
+		})
+	}
+	cw.Flush()
+}
+
+// parseRangeTestRequest validates the body of POST /api/rangetest and fills
+// in the defaults.
+func (h *Hub) parseRangeTestRequest(req rangeTestRequest) (RangeTestConfig, error) {
+	var errs ValidationError
+	c := RangeTestConfig{
+		Mode:     req.Mode,
+		Callsign: req.Callsign,
+		Count:    req.Count,
+		Interval: DEFAULT_PROBE_INTERVAL,
+		Timeout:  DEFAULT_PONG_TIMEOUT,
+	}
+	if c.Mode == "" {
+		c.Mode = RANGE_TEST_PROBE
+	}
+	if c.Mode != RANGE_TEST_PROBE && c.Mode != RANGE_TEST_RESPOND {
+		errs = append(errs, FieldError{"mode", c.Mode, "must be probe or respond"})
+	}
+	if c.Callsign == "" {
+		c.Callsign = h.Callsign
+	}
+	if c.Callsign == "" {
+		errs = append(errs, FieldError{"callsign", "", "is required when the server has no callsign"})
+	}
+	if c.Count < 0 {
+		errs = append(errs, FieldError{"count", strconv.Itoa(c.Count), "must not be negative"})
+	}
+	duration := func(field string, value string, d *time.Duration) {
+		if value == "" {
+			return
+		}
+		v, err := time.ParseDuration(value)
+		if err != nil || v <= 0 {
+			errs = append(errs, FieldError{field, value, "must be a positive duration such as 10s"})
+			return
+		}
+		*d = v
+	}
+	duration("interval", req.Interval, &c.Interval)
+	duration("timeout", req.Timeout, &c.Timeout)
+	duration("delay", req.Delay, &c.Delay)
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// ServeRangeTest implements the /api/rangetest endpoint for the radio
+// parameters in the query string. POST starts a range test, GET returns the
+// report of the current or last one, as CSV with format=csv, and DELETE stops
+// it and returns its report.
+func (h *Hub) ServeRangeTest(w http.ResponseWriter, r *http.Request) {
+	if !h.Access.authorize(w, r, true) {
+		return
+	}
+
+	q := r.URL.Query()
+	params, err := defaultRadioParams.withQuery(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":  "invalid radio parameters",
+			"fields": err,
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req rangeTestRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody)).Decode(&req); err != nil {
+				apiError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		config, err := h.parseRangeTestRequest(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid range test",
+				"fields": err,
+			})
+			return
+		}
+		t, err := h.startRangeTest(params, config)
+		if err == UNAVAILABLE {
+			apiError(w, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		if err != nil {
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, t.report())
+	case http.MethodGet, http.MethodDelete:
+		var t *rangeTest
+		if r.Method == http.MethodDelete {
+			t = h.stopRangeTest(params)
+		} else {
+			h.rangeMu.Lock()
+			t = h.rangeTests[params]
+			h.rangeMu.Unlock()
+		}
+		if t == nil {
+			apiError(w, http.StatusNotFound, "no range test with these radio parameters")
+			return
+		}
+		if q.Get("format") == "csv" {
+			t.report().writeCSV(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, t.report())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,76 @@
+package command_socket
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+)
+
+// retune moves the client to the chat program for the new radio parameters.
+// If the client was the last user of the current program, that program is
+// stopped before the new one is started so that they don't compete for the
+// radio. When the new program fails to start, the client is moved back to
+// the previous parameters.
+func (h *Hub) retune(c *client, params RadioParams) error {
+	old := c.radio
+	if params == old.params {
+		return nil
+	}
+	if err := params.Validate(); err != nil {
+		return err
+	}
+
+	c.log.Info("Retuning", "to", radioID(params))
+	h.mu.Lock()
+	stopped := h.leave(old, c)
+	h.mu.Unlock()
+	if stopped {
+		<-old.done
+	}
+
+	h.mu.Lock()
+	r := h.join(params, c, nil)
+	h.mu.Unlock()
+	if r == nil {
+		c.kick(websocket.CloseGoingAway)
+		return UNAVAILABLE
+	}
+	c.radio = r
+	reason := c.radio.waitReady()
+	if reason == "" {
+		return nil
+	}
+
+	c.log.Info("Retune failed, rolling back", "reason", reason)
+	h.mu.Lock()
+	stopped = h.leave(c.radio, c)
+	h.mu.Unlock()
+	if stopped {
+		<-c.radio.done
+	}
+	h.mu.Lock()
+	r = h.join(old.params, c, nil)
+	h.mu.Unlock()
+	if r == nil {
+		c.kick(websocket.CloseGoingAway)
+		return UNAVAILABLE
+	}
+	c.radio = r
+	return errors.New(reason)
+}
+
+// tune handles a retune request from the client and reports the outcome.
+func (h *Hub) tune(c *client, id string, params RadioParams) {
+	if err := h.retune(c, params); err != nil {
+		c.log.Info("Retune failed", "err", err)
+		f := newFrame(FRAME_ERROR, "Could not retune radio ("+err.Error()+")")
+		f.text = f.Body
+		f.ID = id
+		c.radio.unicast(c, f)
+		return
+	}
+	params = c.radio.params
+	f := statusFrame("radio tuned to " + params.String())
+	f.ID = id
+	f.Params = &params
+	c.radio.unicast(c, f)
+}
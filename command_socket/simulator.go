@@ -0,0 +1,281 @@
+package command_socket
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// First argument that makes wschat run as a simulated radio instead of a
+// server
+const SIMULATOR_ARG = "--simulated-radio"
+
+// SimulatorOptions describe the simulated radio link.
+type SimulatorOptions struct {
+	// Directory in which the simulated radios find each other. Radios using
+	// the same directory and radio parameters hear each other, even when
+	// they are run by different wschat instances.
+	Ether string
+
+	// Probability that a radio misses a packet, from 0 to 1
+	Loss float64
+
+	// Time it takes for a packet to arrive, on top of its time on air
+	Latency time.Duration
+
+	// Probability that a received packet has one byte replaced by 0xff,
+	// which is never valid UTF-8, from 0 to 1
+	Corrupt float64
+
+	// Fraction of the time a radio may spend transmitting, such as 0.01 for
+	// 1%, or 0 for no limit
+	DutyCycle float64
+
+	// Seed for the random number generator, or 0 for a random seed
+	Seed int64
+}
+
+// DefaultEther returns the directory shared by simulated radios by default.
+func DefaultEther() string {
+	return filepath.Join(os.TempDir(), "wschat-ether")
+}
+
+// SimulatorCommand returns the command that runs exe, which must be a wschat
+// binary, as a simulated radio with the given options.
+func SimulatorCommand(exe string, o SimulatorOptions) Command {
+	return Command{
+		Path: exe,
+		Args: []string{
+			SIMULATOR_ARG,
+			"-frequency", "{frequency}",
+			"-bandwidth", "{bandwidth}",
+			"-sf", "{sf}",
+			"-cr", "{cr}",
+			"-ether", o.Ether,
+			"-loss", strconv.FormatFloat(o.Loss, 'f', -1, 64),
+			"-latency", o.Latency.String(),
+			"-corrupt", strconv.FormatFloat(o.Corrupt, 'f', -1, 64),
+			"-duty-cycle", strconv.FormatFloat(o.DutyCycle, 'f', -1, 64),
+			"-seed", strconv.FormatInt(o.Seed, 10),
+		},
+	}
+}
+
+// simulator is a radio that sends the lines written to its input to the
+// other simulated radios over UDP, and prints the lines they send.
+type simulator struct {
+	opts   SimulatorOptions
+	params RadioParams
+	conn   *net.UDPConn
+
+	// Directory of the radios on the same parameters, and this radio's
+	// entry in it, named after its UDP port
+	dir   string
+	entry string
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	out        io.Writer
+	deliveries chan delivery
+
+	// Earliest time the duty cycle allows the next transmission
+	nextTX time.Time
+}
+
+// delivery is a received packet waiting for the latency to pass.
+type delivery struct {
+	at     time.Time
+	packet []byte
+}
+
+// RunSimulator runs a simulated radio with the command line arguments that
+// follow SIMULATOR_ARG. It reads lines to transmit from stdin, prints the
+// lines received from other radios to stdout, and returns the exit code once
+// stdin is closed or stop is closed. Usage and errors are written to stderr,
+// so that they are not mistaken for received lines.
+func RunSimulator(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, stop <-chan struct{}) int {
+	p := defaultRadioParams
+	var o SimulatorOptions
+	fs := flag.NewFlagSet("simulated radio", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Float64Var(&p.frequency, "frequency", p.frequency, "Frequency in MHz")
+	fs.IntVar(&p.bandwidth, "bandwidth", p.bandwidth, "Bandwidth in kHz")
+	fs.IntVar(&p.spreadingFactor, "sf", p.spreadingFactor, "Spreading factor")
+	fs.IntVar(&p.codingRate, "cr", p.codingRate, "Coding rate")
+	fs.StringVar(&o.Ether, "ether", DefaultEther(), "Directory shared by the simulated radios")
+	fs.Float64Var(&o.Loss, "loss", 0, "Probability that a packet is lost")
+	fs.DurationVar(&o.Latency, "latency", 0, "Delivery delay")
+	fs.Float64Var(&o.Corrupt, "corrupt", 0, "Probability that a packet is corrupted")
+	fs.Float64Var(&o.DutyCycle, "duty-cycle", 0, "Fraction of the time the radio may transmit")
+	fs.Int64Var(&o.Seed, "seed", 0, "Random seed")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := p.Validate(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+
+	s := &simulator{
+		opts:   o,
+		params: p,
+		dir:    filepath.Join(o.Ether, radioID(p)),
+		rand:   rand.New(rand.NewSource(o.Seed)),
+		out:    stdout,
+
+		deliveries: make(chan delivery, 64),
+	}
+	if err := s.register(); err != nil {
+		fmt.Fprintln(stderr, "Cannot join the simulated ether:", err)
+		return 1
+	}
+	defer s.unregister()
+	go s.receive()
+	go s.deliver()
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(stdin)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return 0
+			}
+			s.transmit([]byte(line), stop)
+		case <-stop:
+			return 0
+		}
+	}
+}
+
+// register opens the UDP socket and adds the radio to the ether.
+func (s *simulator) register() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	s.entry = filepath.Join(s.dir, strconv.Itoa(port))
+	if err := ioutil.WriteFile(s.entry, nil, 0644); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *simulator) unregister() {
+	os.Remove(s.entry)
+	s.conn.Close()
+}
+
+// peers returns the addresses of the other radios on the same parameters.
+func (s *simulator) peers() []*net.UDPAddr {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	own := filepath.Base(s.entry)
+	var addrs []*net.UDPAddr
+	for _, f := range files {
+		port, err := strconv.Atoi(f.Name())
+		if err != nil || f.Name() == own {
+			continue
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	return addrs
+}
+
+func (s *simulator) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return s.rand.Float64() < p
+}
+
+func (s *simulator) intn(n int) int {
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return s.rand.Intn(n)
+}
+
+// transmit waits for the duty cycle to allow it, keeps the radio busy for
+// the packet's time on air, and sends the packet to the other radios.
+func (s *simulator) transmit(packet []byte, stop <-chan struct{}) {
+	if len(packet) > MAX_PACKET_SIZE {
+		packet = packet[:MAX_PACKET_SIZE]
+	}
+	airtime := timeOnAir(s.params, len(packet))
+	wait := time.Until(s.nextTX)
+	if wait < 0 {
+		wait = 0
+	}
+	select {
+	case <-time.After(wait + airtime):
+	case <-stop:
+		return
+	}
+	for _, addr := range s.peers() {
+		s.conn.WriteToUDP(packet, addr)
+	}
+	s.nextTX = time.Now()
+	if s.opts.DutyCycle > 0 && s.opts.DutyCycle < 1 {
+		off := time.Duration(float64(airtime) * (1/s.opts.DutyCycle - 1))
+		s.nextTX = s.nextTX.Add(off)
+	}
+}
+
+// receive prints the packets sent by other radios, losing, delaying and
+// corrupting them as configured.
+func (s *simulator) receive() {
+	defer close(s.deliveries)
+	buf := make([]byte, MAX_PACKET_SIZE+1)
+	for {
+		n, _, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if s.chance(s.opts.Loss) {
+			continue
+		}
+		packet := append([]byte(nil), buf[:n]...)
+		if len(packet) > 0 && s.chance(s.opts.Corrupt) {
+			// Garble the packet without ever splitting the line
+			packet[s.intn(len(packet))] = 0xff
+		}
+		s.deliveries <- delivery{at: time.Now().Add(s.opts.Latency), packet: packet}
+	}
+}
+
+// deliver prints the received packets in order once they are due.
+func (s *simulator) deliver() {
+	for d := range s.deliveries {
+		time.Sleep(time.Until(d.at))
+		s.out.Write(append(d.packet, '\n'))
+	}
+}
@@ -0,0 +1,144 @@
+package command_socket
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+const (
+	// Delay before the first restart of a crashed chat program
+	restartBackoff = 1 * time.Second
+
+	// Upper bound for the delay between restarts
+	maxRestartBackoff = 30 * time.Second
+
+	// A program that ran for this long is considered healthy, and the
+	// restart counter starts over when it exits
+	stableUptime = 1 * time.Minute
+
+	// A program that exits sooner than this after being started is treated
+	// as having failed to start
+	startupGrace = 1 * time.Second
+)
+
+// backoff returns the delay before the given restart attempt, doubling with
+// each attempt.
+func backoff(attempt int) time.Duration {
+	d := restartBackoff
+	for i := 1; i < attempt && d < maxRestartBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRestartBackoff {
+		d = maxRestartBackoff
+	}
+	return d
+}
+
+// run supervises the chat program. It restarts the program when it exits
+// on its own, until it has failed MaxRestarts times in a row, and
+// disconnects the clients once it gives up or the radio is stopped.
+func (r *Radio) run() {
+	defer r.shutdown()
+
+	attempt := 0
+	for {
+		status := r.spawn()
+
+		select {
+		case <-r.quit:
+			return
+		default:
+		}
+
+		if !status.Started {
+			r.log.Warn("Chat program failed to start", "reason", status.Reason)
+			r.broadcast(statusFrame("radio failed to start (" + status.Reason + ")"))
+		} else {
+			r.log.Warn("Chat program exited", "status", status.Reason)
+			r.broadcast(statusFrame("radio exited (" + status.Reason + ")"))
+		}
+
+		if status.Uptime >= stableUptime {
+			attempt = 0
+		}
+		attempt++
+		if attempt > r.hub.MaxRestarts {
+			r.log.Error("Giving up on chat program", "restarts", r.hub.MaxRestarts)
+			r.broadcast(statusFrame("radio stopped after too many restarts"))
+			return
+		}
+
+		metrics.restarts.inc()
+		delay := backoff(attempt)
+		r.log.Info("Restarting chat program", "delay", delay, "attempt", attempt)
+		r.broadcast(statusFrame(fmt.Sprintf("radio restarting (attempt %d/%d)",
+			attempt, r.hub.MaxRestarts)))
+		select {
+		case <-time.After(delay):
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// spawn runs the chat program once, broadcasting its output, and returns
+// how it ended.
+func (r *Radio) spawn() ExitStatus {
+	exitIO := make(chan ExitStatus, 1)
+	started := make(chan struct{})
+	go func() {
+		exitIO <- SpawnChat(r.hub.Command, r.params, r.quit, started, r.inputIO, r.outputIO, r.diagIO, r.errIO)
+	}()
+
+	expiry := time.NewTicker(time.Second)
+	defer expiry.Stop()
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case now := <-expiry.C:
+			for _, m := range r.reassembler.expire(now) {
+				r.log.Info("Incomplete message", "missing", len(m.missing), "parts", m.total)
+				r.receive(m.line, false)
+				r.broadcast(errorFrame(Error{
+					err: INCOMPLETE,
+					msg: fmt.Sprintf("Last message was incomplete, missing parts %s of %d",
+						joinInts(m.missing), m.total),
+				}))
+			}
+		case <-started:
+			started = nil
+			settled = time.After(startupGrace)
+		case <-settled:
+			r.markReady("")
+		case msg := <-r.outputIO:
+			if line, ok := r.reassembler.add(msg); ok {
+				r.receive(line, true)
+			}
+		case line := <-r.diagIO:
+			r.diagnose(line)
+		case err := <-r.errIO:
+			r.log.Debug("Reporting error to clients", "msg", err.msg, "err", err.err)
+			r.broadcast(errorFrame(err))
+		case status := <-exitIO:
+			if !status.Started || status.Uptime < startupGrace {
+				r.markReady(status.Reason)
+			}
+			return status
+		}
+	}
+}
+
+// shutdown unregisters the radio and disconnects its clients.
+func (r *Radio) shutdown() {
+	r.markReady("radio stopped")
+	r.stopDeliveries()
+	close(r.done)
+	r.hub.mu.Lock()
+	r.hub.forget(r)
+	r.hub.mu.Unlock()
+	r.stop()
+	r.broadcast(statusFrame("radio stopped"))
+	r.disconnectAll(websocket.CloseNormalClosure)
+}
@@ -0,0 +1,516 @@
+package command_socket
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time spent on each radio parameters of a sweep
+	DEFAULT_SWEEP_STEP = 2 * time.Minute
+
+	// Default number of probes sent on each radio parameters of a sweep
+	DEFAULT_SWEEP_PROBES = 5
+
+	// Default time left at the start of each step for both stations to
+	// restart their chat program before probes are sent
+	DEFAULT_SWEEP_GUARD = 5 * time.Second
+)
+
+// States of a sweep step
+const (
+	STEP_PENDING = "pending"
+	STEP_RUNNING = "running"
+	STEP_DONE    = "done"
+	STEP_SKIPPED = "skipped"
+)
+
+// sweepRequest is the body of POST /api/sweep
+type sweepRequest struct {
+	rangeTestRequest
+	Start            string `json:"start"`
+	Step             string `json:"step"`
+	Guard            string `json:"guard"`
+	Probes           int    `json:"probes"`
+	Bandwidths       []int  `json:"bandwidths"`
+	SpreadingFactors []int  `json:"spreadingFactors"`
+	CodingRates      []int  `json:"codingRates"`
+}
+
+// SweepConfig describes a parameter sweep. Both stations must be given the
+// same start, step and radio parameters, so that they switch together.
+type SweepConfig struct {
+	// Range test run on each radio parameters, with the guard time as its
+	// delay
+	RangeTest RangeTestConfig
+
+	// When the first step starts, and how long each step lasts
+	Start time.Time
+	Step  time.Duration
+
+	// Radio parameters of each step, in order
+	Steps []RadioParams
+}
+
+func (c SweepConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"rangeTest": c.RangeTest,
+		"start":     c.Start,
+		"step":      c.Step.String(),
+		"steps":     c.Steps,
+	})
+}
+
+// SweepStep is the outcome of one step of a sweep. The delivery ratio is the
+// fraction of the probes that were answered, or for stations that only
+// respond, the fraction of the peer's probes that were heard. The time on air
+// is the one of a probe, in seconds.
+type SweepStep struct {
+	Params        RadioParams    `json:"params"`
+	Start         time.Time      `json:"start"`
+	State         string         `json:"state"`
+	Error         string         `json:"error,omitempty"`
+	Stats         RangeTestStats `json:"stats"`
+	DeliveryRatio float64        `json:"deliveryRatio"`
+	TimeOnAir     float64        `json:"timeOnAir"`
+	Rank          int            `json:"rank,omitempty"`
+}
+
+// SweepReport is the outcome of a sweep so far. Ranking lists the steps that
+// are done, best first.
+type SweepReport struct {
+	ID       string      `json:"id"`
+	Config   SweepConfig `json:"config"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Steps    []SweepStep `json:"steps"`
+	Ranking  []SweepStep `json:"ranking"`
+}
+
+// sweep is a parameter sweep in progress, or the last one that ran.
+type sweep struct {
+	id     string
+	config SweepConfig
+
+	// Closed to end the sweep early, and once it is over
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu       sync.Mutex
+	steps    []SweepStep
+	finished time.Time
+}
+
+func (s *sweep) end() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *sweep) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait waits until the given time, and returns false if the sweep is ended
+// first.
+func (s *sweep) wait(at time.Time) bool {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+func (s *sweep) update(i int, f func(step *SweepStep)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.steps[i])
+}
+
+// rank orders the steps that are done by delivery ratio, then by time on
+// air, since a shorter packet leaves more room on the channel.
+func rank(steps []SweepStep) []SweepStep {
+	ranking := []SweepStep{}
+	for _, step := range steps {
+		if step.State == STEP_DONE {
+			ranking = append(ranking, step)
+		}
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		if ranking[i].DeliveryRatio != ranking[j].DeliveryRatio {
+			return ranking[i].DeliveryRatio > ranking[j].DeliveryRatio
+		}
+		return ranking[i].TimeOnAir < ranking[j].TimeOnAir
+	})
+	for i := range ranking {
+		ranking[i].Rank = i + 1
+	}
+	return ranking
+}
+
+func (s *sweep) report() SweepReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := SweepReport{
+		ID:      s.id,
+		Config:  s.config,
+		Steps:   append([]SweepStep{}, s.steps...),
+		Ranking: rank(s.steps),
+	}
+	if !s.finished.IsZero() {
+		finished := s.finished
+		r.Finished = &finished
+	}
+	return r
+}
+
+// sweepSteps lists the radio parameters made of the base frequency and every
+// combination of the given values, in ascending order so that both stations
+// agree on it. Empty lists stand for all the supported values.
+func sweepSteps(base RadioParams, bandwidths, spreadingFactors, codingRates []int) ([]RadioParams, error) {
+	var errs ValidationError
+	values := func(field string, list []int, table map[int]int) []int {
+		if len(list) == 0 {
+			for k := range table {
+				list = append(list, k)
+			}
+		}
+		list = append([]int{}, list...)
+		sort.Ints(list)
+		for _, v := range list {
+			if _, ok := table[v]; !ok {
+				errs = append(errs, FieldError{field, strconv.Itoa(v), "must be one of " + tableKeys(table)})
+			}
+		}
+		return list
+	}
+	bws := values("bandwidths", bandwidths, Bandwidths)
+	sfs := values("spreadingFactors", spreadingFactors, SpreadingFactors)
+	crs := values("codingRates", codingRates, CodingRates)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	var steps []RadioParams
+	for _, bw := range bws {
+		for _, sf := range sfs {
+			for _, cr := range crs {
+				p := base
+				p.bandwidth, p.spreadingFactor, p.codingRate = bw, sf, cr
+				steps = append(steps, p)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// parseSweepRequest validates the body of POST /api/sweep and fills in the
+// defaults. The frequency is taken from the base radio parameters.
+func (h *Hub) parseSweepRequest(base RadioParams, req sweepRequest) (SweepConfig, error) {
+	var errs ValidationError
+	if req.Count != 0 {
+		errs = append(errs, FieldError{"count", strconv.Itoa(req.Count), "is not used, set probes instead"})
+	}
+	if req.Probes == 0 {
+		req.Probes = DEFAULT_SWEEP_PROBES
+	}
+	if req.Probes < 0 {
+		errs = append(errs, FieldError{"probes", strconv.Itoa(req.Probes), "must be positive"})
+	}
+	req.Count = req.Probes
+	if req.Guard == "" {
+		req.Guard = DEFAULT_SWEEP_GUARD.String()
+	}
+	req.Delay = req.Guard
+	rt, err := h.parseRangeTestRequest(req.rangeTestRequest)
+	rtValid := err == nil
+	if v, ok := err.(ValidationError); ok {
+		for _, f := range v {
+			if f.Field == "delay" {
+				f.Field = "guard"
+			}
+			errs = append(errs, f)
+		}
+	}
+
+	c := SweepConfig{
+		RangeTest: rt,
+		Start:     time.Now().Truncate(time.Minute).Add(time.Minute),
+		Step:      DEFAULT_SWEEP_STEP,
+	}
+	if req.Start != "" {
+		start, err := time.Parse(time.RFC3339, req.Start)
+		if err != nil {
+			errs = append(errs, FieldError{"start", req.Start, "must be a time such as 2020-03-21T12:00:00Z"})
+		} else if start.Before(time.Now()) {
+			errs = append(errs, FieldError{"start", req.Start, "must not be in the past"})
+		}
+		c.Start = start
+	}
+	if req.Step != "" {
+		step, err := time.ParseDuration(req.Step)
+		if err != nil || step <= 0 {
+			errs = append(errs, FieldError{"step", req.Step, "must be a positive duration such as 2m"})
+		}
+		c.Step = step
+	}
+	// The last probe must have time to be answered before the step is over
+	if need := rt.Delay + time.Duration(rt.Count-1)*rt.Interval + rt.Timeout; rtValid && c.Step > 0 && need > c.Step {
+		errs = append(errs, FieldError{"step", c.Step.String(),
+			fmt.Sprintf("must be at least %v for the guard time, probes and timeout", need)})
+	}
+
+	steps, err := sweepSteps(base, req.Bandwidths, req.SpreadingFactors, req.CodingRates)
+	if v, ok := err.(ValidationError); ok {
+		errs = append(errs, v...)
+	}
+	c.Steps = steps
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// startSweep starts a sweep, unless one is already running. It fails with
+// UNAVAILABLE if the server is shutting down.
+func (h *Hub) startSweep(config SweepConfig) (*sweep, error) {
+	h.rangeMu.Lock()
+	defer h.rangeMu.Unlock()
+	if h.sweep != nil && h.sweep.running() {
+		return nil, fmt.Errorf("sweep %s is already running", h.sweep.id)
+	}
+
+	s := &sweep{
+		id:     newFragmentID(),
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		steps:  make([]SweepStep, len(config.Steps)),
+	}
+	probe := len(probeLine(config.RangeTest.Callsign, s.id, 1))
+	for i, params := range config.Steps {
+		s.steps[i] = SweepStep{
+			Params:    params,
+			Start:     config.Start.Add(time.Duration(i) * config.Step),
+			State:     STEP_PENDING,
+			TimeOnAir: timeOnAir(params, probe).Seconds(),
+		}
+	}
+
+	h.mu.Lock()
+	closing := h.closing
+	if !closing {
+		h.running.Add(1)
+	}
+	h.mu.Unlock()
+	if closing {
+		return nil, UNAVAILABLE
+	}
+	h.sweep = s
+
+	go func() {
+		defer h.running.Done()
+		h.runSweep(s)
+	}()
+	return s, nil
+}
+
+// runSweep runs a range test on each radio parameters of the sweep in turn,
+// which restarts the chat program with them, until the sweep is over. Steps
+// are skipped while a radio with other parameters is running.
+func (h *Hub) runSweep(s *sweep) {
+	log := slog.With("sweep", s.id)
+	log.Info("Sweep scheduled", "start", s.config.Start, "steps", len(s.config.Steps))
+	defer func() {
+		s.mu.Lock()
+		s.finished = time.Now()
+		s.mu.Unlock()
+		close(s.done)
+		log.Info("Sweep finished")
+	}()
+
+	for i, step := range s.report().Steps {
+		if !s.wait(step.Start) {
+			return
+		}
+		if time.Since(step.Start) > s.config.Step/2 {
+			// Too late to keep in step with the peer
+			s.update(i, func(step *SweepStep) { step.State, step.Error = STEP_SKIPPED, "started late" })
+			continue
+		}
+
+		if other := h.otherRadio(step.Params); other != nil {
+			// Two chat programs cannot share the radio
+			s.update(i, func(step *SweepStep) {
+				step.State, step.Error = STEP_SKIPPED, "another radio is running: "+other.String()
+			})
+			continue
+		}
+
+		log.Info("Sweep step started", "step", i+1, "radio", step.Params.String())
+		t, err := h.startRangeTest(step.Params, s.config.RangeTest)
+		if err != nil {
+			s.update(i, func(step *SweepStep) { step.State, step.Error = STEP_SKIPPED, err.Error() })
+			if err == UNAVAILABLE {
+				return
+			}
+			continue
+		}
+		s.update(i, func(step *SweepStep) { step.State = STEP_RUNNING })
+
+		// Let the chat program exit before the next step starts another one
+		ok := s.wait(step.Start.Add(s.config.Step))
+		t.end()
+		<-t.released
+		stats := t.report().Stats
+		s.update(i, func(step *SweepStep) {
+			step.State = STEP_DONE
+			step.Stats = stats
+			if s.config.RangeTest.Mode == RANGE_TEST_RESPOND {
+				step.DeliveryRatio = float64(stats.Heard) / float64(s.config.RangeTest.Count)
+			} else if stats.Sent > 0 {
+				step.DeliveryRatio = float64(stats.Answered) / float64(stats.Sent)
+			}
+			if step.DeliveryRatio > 1 {
+				// Copies of the peer's probes were heard
+				step.DeliveryRatio = 1
+			}
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// otherRadio returns the parameters of a running radio other than the given
+// ones, or nil if there is none.
+func (h *Hub) otherRadio(params RadioParams) *RadioParams {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for p := range h.radios {
+		if p != params {
+			return &p
+		}
+	}
+	return nil
+}
+
+// stopSweep ends the running sweep and waits for it to finish. It returns the
+// last sweep, or nil if there was none.
+func (h *Hub) stopSweep() *sweep {
+	h.rangeMu.Lock()
+	s := h.sweep
+	h.rangeMu.Unlock()
+	if s != nil {
+		s.end()
+		<-s.done
+	}
+	return s
+}
+
+// writeCSV writes the ranking of the report as CSV, best first.
+func (rep SweepReport) writeCSV(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sweep-%s.csv"`, rep.ID))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"rank", "bandwidth", "spreading_factor", "coding_rate", "delivery_ratio",
+		"time_on_air", "sent", "answered", "heard", "rtt", "rssi", "snr"})
+	mean := func(s *Summary) string {
+		if s == nil {
+			return ""
+		}
+		return strconv.FormatFloat(s.Mean, 'f', -1, 64)
+	}
+	for _, step := range rep.Ranking {
+		cw.Write([]string{
+			strconv.Itoa(step.Rank), strconv.Itoa(step.Params.bandwidth),
+			strconv.Itoa(step.Params.spreadingFactor), strconv.Itoa(step.Params.codingRate),
+			strconv.FormatFloat(step.DeliveryRatio, 'f', -1, 64), strconv.FormatFloat(step.TimeOnAir, 'f', -1, 64),
+			strconv.Itoa(step.Stats.Sent), strconv.Itoa(step.Stats.Answered), strconv.Itoa(step.Stats.Heard),
+			mean(step.Stats.RTT), mean(step.Stats.RSSI), mean(step.Stats.SNR),
+		})
+	}
+	cw.Flush()
+}
+
+// ServeSweep implements the /api/sweep endpoint. POST schedules a sweep over
+// the radio parameters in the body, on the frequency in the query string. GET
+// returns the report of the current or last sweep, with the ranking as CSV
+// with format=csv, and DELETE stops it and returns its report.
+func (h *Hub) ServeSweep(w http.ResponseWriter, r *http.Request) {
+	if !h.Access.authorize(w, r, true) {
+		return
+	}
+
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodPost:
+		base, err := defaultRadioParams.withQuery(q)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid radio parameters",
+				"fields": err,
+			})
+			return
+		}
+		var req sweepRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody)).Decode(&req); err != nil {
+				apiError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		config, err := h.parseSweepRequest(base, req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "invalid sweep",
+				"fields": err,
+			})
+			return
+		}
+		s, err := h.startSweep(config)
+		if err == UNAVAILABLE {
+			apiError(w, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		if err != nil {
+			apiError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.report())
+	case http.MethodGet, http.MethodDelete:
+		var s *sweep
+		if r.Method == http.MethodDelete {
+			s = h.stopSweep()
+		} else {
+			h.rangeMu.Lock()
+			s = h.sweep
+			h.rangeMu.Unlock()
+		}
+		if s == nil {
+			apiError(w, http.StatusNotFound, "no sweep")
+			return
+		}
+		if q.Get("format") == "csv" {
+			s.report().writeCSV(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.report())
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,132 @@
+package command_socket
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Arguments passed to the Othernet chat program
+var DEFAULT_ARGS = []string{
+	"-f", "{frequency}",
+	"-b", "{bandwidth.reg}",
+	"-s", "{sf.reg}",
+	"-c", "{cr.reg}",
+}
+
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z.]+)\}`)
+
+// Command describes how the chat program is started. Arguments may contain
+// placeholders that are replaced with the radio parameters:
+//
+//	{frequency}        frequency in MHz
+//	{bandwidth}        bandwidth in kHz
+//	{bandwidth.reg}    register value for the bandwidth
+//	{sf}, {sf.reg}     spreading factor and its register value
+//	{cr}, {cr.reg}     coding rate (5 for 4/5) and its register value
+type Command struct {
+	Path string
+	Args []string
+
+	// Extra environment variables in NAME=VALUE form
+	Env []string
+}
+
+func placeholders(params RadioParams) map[string]string {
+	return map[string]string{
+		"frequency":     strconv.FormatFloat(params.frequency, 'f', -1, 32),
+		"bandwidth":     strconv.Itoa(params.bandwidth),
+		"bandwidth.reg": strconv.Itoa(Bandwidths[params.bandwidth]),
+		"sf":            strconv.Itoa(params.spreadingFactor),
+		"sf.reg":        strconv.Itoa(SpreadingFactors[params.spreadingFactor]),
+		"cr":            strconv.Itoa(params.codingRate),
+		"cr.reg":        strconv.Itoa(CodingRates[params.codingRate]),
+	}
+}
+
+// expand returns the arguments with the placeholders replaced.
+func (c Command) expand(params RadioParams) ([]string, error) {
+	values := placeholders(params)
+	args := make([]string, len(c.Args))
+	var err error
+	for i, arg := range c.Args {
+		args[i] = placeholderRe.ReplaceAllStringFunc(arg, func(p string) string {
+			name := p[1 : len(p)-1]
+			v, ok := values[name]
+			if !ok {
+				err = fmt.Errorf("unknown placeholder %s in argument %q", p, arg)
+			}
+			return v
+		})
+	}
+	return args, err
+}
+
+// Check verifies that the arguments only use known placeholders and that
+// the environment variables are well formed.
+func (c Command) Check() error {
+	if _, err := c.expand(defaultRadioParams); err != nil {
+		return err
+	}
+	for _, e := range c.Env {
+		if i := strings.Index(e, "="); i < 1 {
+			return fmt.Errorf("environment variable %q is not in NAME=VALUE form", e)
+		}
+	}
+	return nil
+}
+
+func (c Command) build(params RadioParams) (*exec.Cmd, error) {
+	args, err := c.expand(params)
+	if err != nil {
+		return nil, err
+	}
+	proc := exec.Command(c.Path, args...)
+	if len(c.Env) > 0 {
+		proc.Env = append(os.Environ(), c.Env...)
+	}
+	return proc, nil
+}
+
+// SplitArgs splits a command line into arguments. Arguments are separated by
+// white space, and single or double quotes can be used to keep white space
+// inside an argument.
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in arguments")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
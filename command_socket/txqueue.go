@@ -0,0 +1,308 @@
+package command_socket
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default number of messages a callsign may send in a row before the rate
+// limit applies
+const DEFAULT_RATE_BURST = 3
+
+// Messages that are expected to wait at least this long are announced to
+// plain text clients
+const announceWait = time.Second
+
+// txJob is a message waiting in the transmit queue.
+type txJob struct {
+	lines    [][]byte
+	callsign string
+	limited  bool
+	airtime  time.Duration
+
+	// Receives the outcome once the lines are written or the radio stops
+	done chan error
+}
+
+// bucket holds the messages a callsign may send before the rate limit
+// applies, refilled at the hub's RateLimit.
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// txQueue schedules the messages written to the chat program. Messages are
+// sent in order, except that a message held back by its callsign's rate
+// limit does not hold back the others. With a duty cycle, each message keeps
+// the channel busy for its time on air divided by the duty cycle.
+type txQueue struct {
+	dutyCycle float64
+	rate      float64 // Messages per second for each callsign, 0 for no limit
+	burst     float64
+
+	mu      sync.Mutex
+	jobs    []*txJob
+	buckets map[string]*bucket
+	nextTX  time.Time
+
+	// Signalled when a message is added
+	wake chan struct{}
+}
+
+func newTxQueue(h *Hub) *txQueue {
+	burst := h.RateBurst
+	if burst < 1 {
+		burst = 1
+	}
+	return &txQueue{
+		dutyCycle: h.DutyCycle,
+		rate:      h.RateLimit / 60,
+		burst:     float64(burst),
+		buckets:   map[string]*bucket{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// spacing returns how long a message keeps the channel busy.
+func (q *txQueue) spacing(airtime time.Duration) time.Duration {
+	if q.dutyCycle <= 0 || q.dutyCycle >= 1 {
+		return 0
+	}
+	return time.Duration(float64(airtime) / q.dutyCycle)
+}
+
+// tokens returns how many messages the callsign may send at the given time.
+// The caller must hold q.mu.
+func (q *txQueue) tokens(callsign string, now time.Time) float64 {
+	b := q.buckets[callsign]
+	if b == nil {
+		return q.burst
+	}
+	t := b.tokens + now.Sub(b.at).Seconds()*q.rate
+	if t > q.burst {
+		t = q.burst
+	}
+	return t
+}
+
+// readyAt returns when the job may be sent as far as its rate limit is
+// concerned, if n messages of the same callsign are sent before it. The
+// caller must hold q.mu.
+func (q *txQueue) readyAt(j *txJob, n int, now time.Time) time.Time {
+	if !j.limited || q.rate <= 0 {
+		return now
+	}
+	missing := float64(n+1) - q.tokens(j.callsign, now)
+	if missing <= 0 {
+		return now
+	}
+	return now.Add(time.Duration(missing / q.rate * float64(time.Second)))
+}
+
+// add queues a job and returns the number of messages ahead of it and an
+// estimate of when it will be sent.
+func (q *txQueue) add(j *txJob) (int, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	eta := now
+	if q.nextTX.After(eta) {
+		eta = q.nextTX
+	}
+	same := 0
+	for _, other := range q.jobs {
+		eta = eta.Add(q.spacing(other.airtime))
+		if other.limited && other.callsign == j.callsign {
+			same++
+		}
+	}
+	if ready := q.readyAt(j, same, now); ready.After(eta) {
+		eta = ready
+	}
+
+	ahead := len(q.jobs)
+	q.jobs = append(q.jobs, j)
+	metrics.txQueue.add(1)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return ahead, eta
+}
+
+// cancel removes a job that has not been sent yet. It reports false if the
+// job was already taken out of the queue, in which case its outcome is still
+// sent on its done channel.
+func (q *txQueue) cancel(j *txJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.jobs {
+		if other == j {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			metrics.txQueue.add(-1)
+			return true
+		}
+	}
+	return false
+}
+
+// next removes and returns the first job that may be sent now. Otherwise it
+// returns how long to wait before trying again, or 0 if the queue is empty.
+func (q *txQueue) next(now time.Time) (*txJob, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return nil, 0
+	}
+	if q.nextTX.After(now) {
+		return nil, q.nextTX.Sub(now)
+	}
+
+	var wait time.Duration
+	for i, j := range q.jobs {
+		ready := q.readyAt(j, 0, now)
+		if !ready.After(now) {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			metrics.txQueue.add(-1)
+			q.sent(j, now)
+			return j, 0
+		}
+		if d := ready.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// sent charges the job to its callsign and the duty cycle. The caller must
+// hold q.mu.
+func (q *txQueue) sent(j *txJob, now time.Time) {
+	q.nextTX = now.Add(q.spacing(j.airtime))
+	if j.limited && q.rate > 0 {
+		q.buckets[j.callsign] = &bucket{tokens: q.tokens(j.callsign, now) - 1, at: now}
+	}
+}
+
+// clear fails the queued jobs once the radio is stopped.
+func (q *txQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metrics.txQueue.add(-int64(len(q.jobs)))
+	for _, j := range q.jobs {
+		j.done <- UNAVAILABLE
+	}
+	q.jobs = nil
+}
+
+// schedule writes the queued messages to the chat program's input until the
+// radio is stopped.
+func (r *Radio) schedule() {
+	defer r.tx.clear()
+	for {
+		j, wait := r.tx.next(time.Now())
+		if j == nil {
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-r.tx.wake:
+			case <-timer:
+			case <-r.quit:
+				return
+			}
+			continue
+		}
+
+		j.done <- r.writeLines(j.lines)
+	}
+}
+
+// writeLines hands the lines of one message to the chat program.
+func (r *Radio) writeLines(lines [][]byte) error {
+	for _, line := range lines {
+		select {
+		case r.inputIO <- line:
+		case <-r.quit:
+			return UNAVAILABLE
+		case <-r.done:
+			return UNAVAILABLE
+		}
+	}
+	return nil
+}
+
+// transmit queues a message for the chat program's input, split into
+// fragments if it is too long, and waits until it is written. Messages from
+// clients are limited, and count towards the rate limit of their callsign.
+// The queued function, if given, is called with the number of messages ahead
+// and an estimate of when the message will be sent. It fails with
+// UNAVAILABLE if the radio is shutting down or cancel is closed first.
+func (r *Radio) transmit(msg []byte, limited bool, cancel <-chan struct{}, queued func(int, time.Time)) error {
+	j, err := r.enqueue(msg, limited, queued)
+	if err != nil {
+		return err
+	}
+	return r.await(j, cancel)
+}
+
+// enqueue implements the first half of transmit. It queues the message and
+// returns without waiting for it to be written.
+func (r *Radio) enqueue(msg []byte, limited bool, queued func(int, time.Time)) (*txJob, error) {
+	lines, err := fragment(msg)
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := splitLine(string(msg))
+	j := &txJob{
+		lines:    lines,
+		callsign: callsignOf(prefix),
+		limited:  limited,
+		done:     make(chan error, 1),
+	}
+	for _, line := range lines {
+		j.airtime += timeOnAir(r.params, len(line))
+	}
+
+	select {
+	case <-r.quit:
+		return nil, UNAVAILABLE
+	default:
+	}
+	ahead, eta := r.tx.add(j)
+	if queued != nil {
+		queued(ahead, eta)
+	}
+	return j, nil
+}
+
+// await implements the second half of transmit. It waits until the queued
+// message is written, and takes it out of the queue if the radio shuts down
+// or cancel is closed first. A message the scheduler has already taken is
+// waited for, since it may have been written.
+func (r *Radio) await(j *txJob, cancel <-chan struct{}) error {
+	select {
+	case err := <-j.done:
+		return err
+	case <-cancel:
+	case <-r.quit:
+	case <-r.done:
+	}
+	if r.tx.cancel(j) {
+		return UNAVAILABLE
+	}
+	return <-j.done
+}
+
+// queuedFrame tells the client that its message is waiting to be sent.
+// Plain text clients are only told if the wait is noticeable.
+func queuedFrame(id string, attempt int, ahead int, eta time.Time) Frame {
+	f := deliveryFrame(id, DELIVERY_QUEUED, attempt)
+	f.Queue = ahead
+	f.ETA = &eta
+	if wait := time.Until(eta); wait >= announceWait {
+		f.text = fmt.Sprintf("Message queued, %d ahead, sending in %v", ahead, wait.Round(time.Second))
+	}
+	return f
+}
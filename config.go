@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// loadConfig reads a JSON object whose keys are flag names and applies its
+// values to the flags of the set that were not given on the command line.
+// Lists are used for flags that can be given multiple times.
+func loadConfig(flags *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(string(data)))
+	d.UseNumber()
+	if err := d.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, value := range settings {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			switch v.(type) {
+			case string, json.Number, bool:
+			default:
+				return fmt.Errorf("%s: setting %q must be a string, number, boolean or a list of those", path, name)
+			}
+			if err := flags.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: setting %q: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		config string
+		want   string
+		err    string
+	}{
+		{"values", nil,
+			`{"addr": ":8081", "max-restarts": 3, "verbose": true, "allow-ip": ["10.0.0.0/8", "::1"]}`,
+			"addr=:8081 max-restarts=3 verbose=true allow-ip=10.0.0.0/8, ::1", ""},
+		{"command line wins", []string{"-addr", ":9000", "-allow-ip", "127.0.0.1"},
+			`{"addr": ":8081", "max-restarts": 3, "allow-ip": ["10.0.0.0/8"]}`,
+			"addr=:9000 max-restarts=3 verbose=false allow-ip=127.0.0.1", ""},
+		{"empty", nil, `{}`, "addr=:8080 max-restarts=5 verbose=false allow-ip=", ""},
+		{"invalid JSON", nil, `{"addr": ":8081",}`, "", "invalid character"},
+		{"not an object", nil, `[":8081"]`, "", "cannot unmarshal array"},
+		{"unknown setting", nil, `{"adr": ":8081"}`, "", `unknown setting "adr"`},
+		{"null", nil, `{"addr": null}`, "", `setting "addr" must be a string, number, boolean or a list of those`},
+		{"object", nil, `{"addr": {"port": 8081}}`, "", `setting "addr" must be a string`},
+		{"nested list", nil, `{"allow-ip": [["::1"]]}`, "", `setting "allow-ip" must be a string`},
+		{"wrong type", nil, `{"max-restarts": "often"}`, "", `setting "max-restarts": parse error`},
+		{"fraction", nil, `{"max-restarts": 1.5}`, "", `setting "max-restarts"`},
+		{"wrong boolean", nil, `{"verbose": "maybe"}`, "", `setting "verbose"`},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("wschat", flag.ContinueOnError)
+		addr := flags.String("addr", ":8080", "")
+		restarts := flags.Int("max-restarts", 5, "")
+		verbose := flags.Bool("verbose", false, "")
+		var allowIPs stringList
+		flags.Var(&allowIPs, "allow-ip", "")
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "wschat.json")
+		if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := loadConfig(flags, path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) || !strings.HasPrefix(err.Error(), path+": ") {
+				t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		got := fmt.Sprintf("addr=%s max-restarts=%d verbose=%v allow-ip=%s", *addr, *restarts, *verbose, allowIPs.String())
+		if got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	flags := flag.NewFlagSet("wschat", flag.ContinueOnError)
+	if err := loadConfig(flags, filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: expected a not exist error, got %v", err)
+	}
+}
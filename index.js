@@ -7,7 +7,8 @@ import ReactDOM from 'react-dom'
 // CONSTANTS
 // -----------------------------------------------------------------------------
 
-const MAX_MESSAGE_LENGTH = 47
+// Longer messages are split into 47 character fragments by the server
+const MAX_MESSAGE_LENGTH = 300
 const DEFAULT_FREQUENCY = 1000
 const DEFAULT_BANDWIDTH = 400
 const DEFAULT_CODING_RATE = 5
@@ -36,6 +37,13 @@ const CODING_RATE_OPTIONS = [
   ['4/8', 8],
 ]
 const ORIGIN = window.location.origin.split(':').slice(1).join(':')
+const WS_SCHEME = window.location.protocol === 'https:' ? 'wss' : 'ws'
+// Lines from the chat program are parsed by the server and sent as JSON frames
+const JSON_PROTOCOL = 'wschat.json.v1'
+// Frames shown in the chat as coming from the system
+const SYSTEM_FRAMES = ['system', 'status', 'error']
+// How often the link statistics are refreshed, in milliseconds
+const LINKS_INTERVAL = 10000
 
 const ME = Symbol('me')
 const SYSTEM = Symbol('system')
@@ -113,12 +121,6 @@ const CALLSIGN_STYLE = {
 // APPLICATION STATE
 // -----------------------------------------------------------------------------
 
-function parseMessage (text) {
-  let m = /^\[([^\]]+)]:(.*)$/.exec(text)
-  if (!m) return [SYSTEM, text]
-  return [m[1], m[2].trim()]
-}
-
 let state = observable({
   callsign: localStorage.callsign || 'Anonymous',
   params: {
@@ -128,10 +130,20 @@ let state = observable({
     codingRate: '' + DEFAULT_CODING_RATE,
   },
   messages: [],
+  links: [],
+  linksTimer: null,
   text: '',
   charCount: 0,
   socket: null,
 
+  get query () {
+    let q = []
+    for (let [param, value] of Object.entries(this.params)) {
+      q.push(`${param}=${encodeURIComponent(value)}`)
+    }
+    return q.join('&')
+  },
+
   get charsRemaining () {
     return MAX_MESSAGE_LENGTH - this.charCount
   },
@@ -161,27 +173,43 @@ let state = observable({
   connect () {
     let model = this
     localStorage.callsign = model.callsign
-    let q = []
-    for (let [param, value] of Object.entries(model.params)) {
-      q.push(`${param}=${encodeURIComponent(value)}`)
-    }
-    let ws = new WebSocket(`ws://${ORIGIN}/sock?${q.join('&')}`)
+    let ws = new WebSocket(`${WS_SCHEME}:${ORIGIN}/sock?${model.query}`, JSON_PROTOCOL)
     ws.onmessage = function ({ data }) {
-      if (data.startsWith('>')) data = data.slice(1)
-      let [callsign, text] = parseMessage(data)
-      if (text) model.addMessage(callsign, text)
+      let frame = JSON.parse(data)
+      if (!frame.body) return
+      if (frame.type === 'message') model.addMessage(frame.callsign, frame.body)
+      else if (SYSTEM_FRAMES.includes(frame.type)) model.addMessage(SYSTEM, frame.body)
     }
     ws.onclose = function () {
       model.socket = null
+      clearInterval(model.linksTimer)
     }
     ws.onerror = function () {
       alert('Connection error. Server may be offline.')
     }
     ws.onopen = function () {
       model.socket = ws
+      model.fetchLinks()
+      model.linksTimer = setInterval(function () {
+        model.fetchLinks()
+      }, LINKS_INTERVAL)
     }
   },
 
+  fetchLinks () {
+    let model = this
+    fetch(`/api/links?${model.query}`)
+      .then(function (res) {
+        return res.ok ? res.json() : { links: [] }
+      })
+      .then(function ({ links }) {
+        runInAction(function () {
+          model.links = links
+        })
+      })
+      .catch(function () {})
+  },
+
   disconnect () {
     this.socket.close()
   },
@@ -189,7 +217,11 @@ let state = observable({
   send () {
     let model = this
     if (this.socket) {
-      this.socket.send(`[${this.callsign}]: ${this.text}`)
+      this.socket.send(JSON.stringify({
+        type: 'message',
+        callsign: this.callsign,
+        body: this.text,
+      }))
       runInAction(function () {
         model.addMessage(ME, model.text)
         model.text = ''
@@ -267,6 +299,44 @@ let LinkButton = observer(function ({ children, onClick }) {
   )
 })
 
+function formatSummary (summary) {
+  if (!summary) return '-'
+  return `${summary.mean.toFixed(1)} (${summary.min} to ${summary.max})`
+}
+
+let LinkStats = observer(function () {
+  if (!state.links.length) return null
+
+  return (
+    <table style={{ width: '100%', marginBottom: '0.5rem', fontSize: '0.8rem' }}>
+      <thead>
+        <tr style={{ textAlign: 'left' }}>
+          <th>Station</th>
+          <th>Messages</th>
+          <th>RSSI (dBm)</th>
+          <th>SNR (dB)</th>
+          <th>CRC errors</th>
+          <th>Last heard</th>
+        </tr>
+      </thead>
+      <tbody>
+        {state.links.map(function (link) {
+          return (
+            <tr key={link.callsign}>
+              <td style={CALLSIGN_STYLE}>{link.callsign}</td>
+              <td>{link.messages}</td>
+              <td>{formatSummary(link.rssi)}</td>
+              <td>{formatSummary(link.snr)}</td>
+              <td>{link.crcErrors} / {link.window}</td>
+              <td>{new Date(link.lastHeard).toLocaleTimeString()}</td>
+            </tr>
+          )
+        })}
+      </tbody>
+    </table>
+  )
+})
+
 let Message = observer(function ({ message }) {
   let messageStyle = {
     ...MESSAGE_BACKGROUND,
@@ -383,6 +453,7 @@ let ChatWindow = observer(function () {
             CR: 4 / {state.params.codingRate}
           </LinkButton>
         </div>
+        <LinkStats/>
         <ul
           ref={output}
           style={{
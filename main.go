@@ -3,49 +3,365 @@ package main
 import (
 	"./command_socket"
 	_ "./statik"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/rakyll/statik/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const VERSION = "0.0.7"
 
+// Exit codes
+const (
+	EXIT_OK               = 0 // Shut down cleanly after a signal
+	EXIT_SERVER_ERROR     = 1 // The server could not be started or failed
+	EXIT_SHUTDOWN_TIMEOUT = 2 // Sessions or processes were still running at the deadline
+)
+
 var (
 	addr    = flag.String("addr", "127.0.0.1:8080", "http service address")
 	version = flag.Bool("version", false, "Print the version and exit")
+
+	maxRestarts = flag.Int("max-restarts", command_socket.DEFAULT_MAX_RESTARTS,
+		"How many times in a row to restart a crashed chat program")
+
+	historyDir = flag.String("history-dir", "",
+		"Directory in which to keep the message history (kept in memory if empty)")
+	historySize = flag.Int("history-size", command_socket.DEFAULT_HISTORY_SIZE,
+		"Number of messages kept in the history for each radio configuration")
+	historyReplay = flag.Int("history-replay", command_socket.DEFAULT_HISTORY_REPLAY,
+		"Number of messages replayed to newly connected clients")
+	apiLinger = flag.Duration("api-linger", command_socket.DEFAULT_API_LINGER,
+		"How long a radio started through the REST API keeps running after the last request")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 15*time.Second,
+		"How long to wait for sessions and chat programs to finish when shutting down")
+
+	tlsCert       = flag.String("tls-cert", "", "Serve HTTPS with this certificate file")
+	tlsKey        = flag.String("tls-key", "", "Private key for the certificate given with --tls-cert")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false,
+		"Serve HTTPS with a self-signed certificate kept next to the binary, generated on first run")
+	redirectAddr = flag.String("http-redirect", "",
+		"Also listen for plain HTTP on this address and redirect it to HTTPS")
+
+	token        = flag.String("token", "", "Require this shared secret for the chat and the API")
+	allowOrigins stringList
+	allowIPs     stringList
+	denyIPs      stringList
+
+	logLevel = flag.String("log-level", command_socket.DEFAULT_LOG_LEVEL,
+		"Lowest level of log messages to write: debug, info, warn or error (message bodies are only logged at debug)")
+	logFormat = flag.String("log-format", command_socket.LOG_FORMAT_LOGFMT, "Format of log messages: logfmt or json")
+
+	config  = flag.String("config", "", "Read settings from a JSON file")
+	command = flag.String("command", "", "Path to the chat program, if not given as an argument")
+	cmdArgs = flag.String("args", strings.Join(command_socket.DEFAULT_ARGS, " "),
+		"Arguments for the chat program, with placeholders for radio parameters")
+	cmdEnv stringList
+
+	simulate = flag.Bool("simulate", false, "Use a simulated radio instead of the chat program")
+	simEther = flag.String("sim-ether", command_socket.DefaultEther(),
+		"Directory shared by simulated radios that can hear each other")
+	simLoss      = flag.Float64("sim-loss", 0, "Probability (0 to 1) that a simulated radio misses a packet")
+	simLatency   = flag.Duration("sim-latency", 0, "Delay before a simulated packet arrives, on top of its time on air")
+	simCorrupt   = flag.Float64("sim-corrupt", 0, "Probability (0 to 1) that a simulated packet arrives garbled")
+	simDutyCycle = flag.Float64("sim-duty-cycle", 0,
+		"Fraction of the time a simulated radio may transmit, such as 0.01, or 0 for no limit")
+	simSeed = flag.Int64("sim-seed", 0, "Random seed for the simulated radios, random if 0")
+
+	acks       = flag.Bool("acks", false, "Tag outgoing messages and wait for peers to acknowledge them")
+	callsign   = flag.String("callsign", "", "Callsign to acknowledge messages with")
+	ackTimeout = flag.Duration("ack-timeout", command_socket.DEFAULT_ACK_TIMEOUT,
+		"Time to wait for an acknowledgement before retransmitting or giving up")
+	retransmit = flag.Int("retransmit", 0, "Number of times an unacknowledged message is sent again")
+
+	dutyCycle = flag.Float64("duty-cycle", 0,
+		"Fraction of the time each radio may spend transmitting, such as 0.01, or 0 for no limit")
+	rateLimit = flag.Float64("rate-limit", 0, "Messages per minute each callsign may send once its burst is used up, or 0 for no limit")
+	rateBurst = flag.Int("rate-burst", command_socket.DEFAULT_RATE_BURST, "Messages each callsign may send in a row before --rate-limit applies")
+
+	dedup       = flag.String("dedup", command_socket.DEDUP_OFF, "What to do with copies of a received message: off, drop or count")
+	dedupWindow = flag.Duration("dedup-window", command_socket.DEFAULT_DEDUP_WINDOW,
+		"Time during which copies of a received message are recognized")
+	dedupRadios stringList
+
+	parserRules stringList
+	linkWindow  = flag.Int("link-window", command_socket.DEFAULT_LINK_WINDOW,
+		"Number of recent messages the link statistics of each station are based on")
 )
 
+func init() {
+	flag.Var(&cmdEnv, "env", "Set an environment variable (NAME=VALUE) for the chat program, can be repeated")
+	flag.Var(&allowOrigins, "allow-origin", "Allow browsers on this origin (or * for any) to connect, can be repeated")
+	flag.Var(&allowIPs, "allow-ip", "Only allow clients from this address or CIDR network, can be repeated")
+	flag.Var(&denyIPs, "deny-ip", "Reject clients from this address or CIDR network, can be repeated")
+	flag.Var(&parserRules, "parser",
+		"Recognize the chat program's output lines that match a regexp, given as type:regexp, can be repeated")
+	flag.Var(&dedupRadios, "dedup-radio",
+		"Duplicate suppression for some radio parameters, such as frequency=868&dedup=count&dedupWindow=1m, can be repeated")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == command_socket.SIMULATOR_ARG {
+		os.Exit(runSimulator(os.Args[2:]))
+	}
+
 	flag.Parse()
 
+	if *config != "" {
+		if err := loadConfig(flag.CommandLine, *config); err != nil {
+			fatal(err)
+		}
+	}
+
+	logger, err := command_socket.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fatal(err)
+	}
+	slog.SetDefault(logger)
+
 	if *version {
 		fmt.Printf("Dreamcatcher chat v%s\n", VERSION)
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) < 1 {
-		log.Fatal("You must specify the command to run")
+	chat, err := chatCommand()
+	if err != nil {
+		fatal(err)
+	}
+	if err := chat.Check(); err != nil {
+		fatal(err)
+	}
+
+	if *dutyCycle < 0 || *dutyCycle > 1 {
+		fatal("--duty-cycle must be between 0 and 1")
+	}
+	if *linkWindow < 1 {
+		fatal("--link-window must be at least 1")
+	}
+	if *rateLimit < 0 {
+		fatal("--rate-limit must not be negative")
+	}
+
+	defaultDedup, radioDedup, err := dedupConfig()
+	if err != nil {
+		fatal(err)
+	}
+
+	parser, err := lineParser()
+	if err != nil {
+		fatal(err)
+	}
+
+	history, err := command_socket.NewHistory(*historyDir, *historySize)
+	if err != nil {
+		fatal(err)
+	}
+
+	access := &command_socket.AccessControl{
+		AllowedOrigins: allowOrigins,
+		Token:          *token,
+	}
+	if access.AllowIPs, err = command_socket.ParseNetworks(allowIPs); err != nil {
+		fatal(err)
+	}
+	if access.DenyIPs, err = command_socket.ParseNetworks(denyIPs); err != nil {
+		fatal(err)
 	}
-	cmd, err := exec.LookPath(flag.Args()[0])
+
+	tlsConfig, err := loadTLS(*tlsCert, *tlsKey, *tlsSelfSigned, *addr)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if *redirectAddr != "" && tlsConfig == nil {
+		fatal("--http-redirect needs HTTPS to be enabled")
 	}
 
 	feAssets, err := fs.New()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	fmt.Printf("Dreamcatcher chat v%s\n", VERSION)
-	fmt.Println("Starting the server at", *addr)
+	if tlsConfig != nil {
+		fmt.Println("Starting the server at https://" + *addr)
+	} else {
+		fmt.Println("Starting the server at", *addr)
+	}
+
+	hub := command_socket.NewHub(chat.Path)
+	hub.Command = chat
+	hub.MaxRestarts = *maxRestarts
+	hub.History = history
+	hub.HistoryReplay = *historyReplay
+	hub.APILinger = *apiLinger
+	hub.Access = access
+	hub.Acks = *acks
+	hub.Callsign = *callsign
+	hub.AckTimeout = *ackTimeout
+	hub.Retransmits = *retransmit
+	hub.DutyCycle = *dutyCycle
+	hub.RateLimit = *rateLimit
+	hub.RateBurst = *rateBurst
+	hub.Parser = parser
+	hub.LinkWindow = *linkWindow
+	hub.Dedup = defaultDedup
+	hub.DedupRadios = radioDedup
+	http.HandleFunc("/sock", hub.ServeSock)
+	http.HandleFunc("/api/messages", hub.ServeMessages)
+	http.HandleFunc("/api/links", hub.ServeLinks)
+	http.HandleFunc("/api/rangetest", hub.ServeRangeTest)
+	http.HandleFunc("/api/sweep", hub.ServeSweep)
+	http.HandleFunc("/metrics", hub.ServeMetrics)
+	http.Handle("/", access.Protect(http.StripPrefix("/", http.FileServer(feAssets))))
+
+	servers := []*http.Server{{Addr: *addr, TLSConfig: tlsConfig}}
+	if *redirectAddr != "" {
+		fmt.Println("Redirecting plain HTTP from", *redirectAddr)
+		servers = append(servers, &http.Server{Addr: *redirectAddr, Handler: redirectToHTTPS(*addr)})
+	}
+	status := serve(servers, hub)
+	history.Close()
+	os.Exit(status)
+}
+
+// chatCommand returns how the chat program is started, from the command line
+// or the configuration file.
+func chatCommand() (command_socket.Command, error) {
+	if *simulate {
+		exe, err := os.Executable()
+		if err != nil {
+			return command_socket.Command{}, err
+		}
+		chat := command_socket.SimulatorCommand(exe, command_socket.SimulatorOptions{
+			Ether:     *simEther,
+			Loss:      *simLoss,
+			Latency:   *simLatency,
+			Corrupt:   *simCorrupt,
+			DutyCycle: *simDutyCycle,
+			Seed:      *simSeed,
+		})
+		chat.Env = cmdEnv
+		return chat, nil
+	}
+
+	if len(flag.Args()) > 0 {
+		*command = flag.Args()[0]
+	}
+	if *command == "" {
+		return command_socket.Command{}, errors.New("You must specify the command to run")
+	}
+	cmd, err := exec.LookPath(*command)
+	if err != nil {
+		return command_socket.Command{}, err
+	}
+	args, err := command_socket.SplitArgs(*cmdArgs)
+	if err != nil {
+		return command_socket.Command{}, err
+	}
+	return command_socket.Command{Path: cmd, Args: args, Env: cmdEnv}, nil
+}
 
-	http.HandleFunc("/sock", func(w http.ResponseWriter, r *http.Request) {
-		command_socket.ServeSock(w, r, cmd)
-	})
-	http.Handle("/", http.StripPrefix("/", http.FileServer(feAssets)))
-	http.ListenAndServe(*addr, nil)
+// runSimulator runs wschat as a simulated radio until its input is closed or
+// it is interrupted, and returns the exit code.
+func runSimulator(args []string) int {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		<-sig
+		close(stop)
+	}()
+	return command_socket.RunSimulator(args, os.Stdin, os.Stdout, os.Stderr, stop)
+}
+
+// fatal logs the error and exits.
+func fatal(err interface{}) {
+	slog.Error(fmt.Sprint(err))
+	os.Exit(EXIT_SERVER_ERROR)
+}
+
+// serve runs the servers until one fails or the process receives SIGINT or
+// SIGTERM, and then shuts them down. Servers with a TLS configuration serve
+// HTTPS. It returns the exit code.
+func serve(servers []*http.Server, hub *command_socket.Hub) int {
+	errIO := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errIO <- srv.ListenAndServeTLS("", "")
+			} else {
+				errIO <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	status := EXIT_OK
+	select {
+	case err := <-errIO:
+		slog.Error("Server failed", "err", err)
+		status = EXIT_SERVER_ERROR
+	case s := <-sig:
+		slog.Info("Received signal, shutting down", "signal", s.String())
+	}
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections first, then end the sessions, which were
+	// hijacked from the server and are not covered by its shutdown
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("Could not shut down the server", "addr", srv.Addr, "err", err)
+		}
+	}
+	if err := hub.Shutdown(ctx); err != nil && status == EXIT_OK {
+		status = EXIT_SHUTDOWN_TIMEOUT
+	}
+	return status
+}
+
+// dedupConfig returns the default duplicate suppression settings, and the
+// ones given for specific radio parameters.
+func dedupConfig() (command_socket.DedupConfig, map[command_socket.RadioParams]command_socket.DedupConfig, error) {
+	def := command_socket.DedupConfig{Mode: *dedup, Window: *dedupWindow}
+	if err := def.Validate(); err != nil {
+		return def, nil, err
+	}
+	radios := map[command_socket.RadioParams]command_socket.DedupConfig{}
+	for _, rule := range dedupRadios {
+		params, d, err := command_socket.ParseDedupRule(rule, def)
+		if err != nil {
+			return def, nil, fmt.Errorf("--dedup-radio %s: %v", rule, err)
+		}
+		radios[params] = d
+	}
+	return def, radios, nil
+}
+
+// lineParser returns the parser for the chat program's output, which tries
+// the rules given with --parser before the built-in Othernet parser.
+func lineParser() (command_socket.LineParser, error) {
+	var chain command_socket.ParserChain
+	for _, rule := range parserRules {
+		p, err := command_socket.ParseParserRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("--parser %s: %v", rule, err)
+		}
+		chain = append(chain, p)
+	}
+	return append(chain, command_socket.OthernetParser{}), nil
 }
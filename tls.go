@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Names of the self-signed certificate files stored next to the binary
+const (
+	SELF_SIGNED_CERT = "wschat.crt"
+	SELF_SIGNED_KEY  = "wschat.key"
+)
+
+// How long a generated certificate is valid
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// selfSignedPaths returns where the self-signed certificate is kept.
+func selfSignedPaths() (string, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Dir(exe)
+	return filepath.Join(dir, SELF_SIGNED_CERT), filepath.Join(dir, SELF_SIGNED_KEY), nil
+}
+
+// certificateHosts lists the names and addresses the generated certificate
+// is valid for: the listening host, localhost, and the addresses of the
+// network interfaces, so that the device can be reached by its IP address.
+func certificateHosts(addr string) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil {
+			names = append(names, host)
+		} else if !ip.IsUnspecified() && !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	return names, ips
+}
+
+// generateCertificate writes a new self-signed certificate and its key.
+func generateCertificate(certPath, keyPath, addr string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	names, ips := certificateHosts(addr)
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Dreamcatcher chat"}, CommonName: names[len(names)-1]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path string, typ string, der []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadTLS returns the TLS configuration for the server, or nil if it should
+// serve plain HTTP. With selfSigned and no certificate given, a certificate
+// is generated on first run and reused afterwards.
+func loadTLS(certPath, keyPath string, selfSigned bool, addr string) (*tls.Config, error) {
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if certPath == "" {
+		if !selfSigned {
+			return nil, nil
+		}
+		var err error
+		if certPath, keyPath, err = selfSignedPaths(); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			slog.Info("Generating a self-signed certificate", "path", certPath)
+			if err := generateCertificate(certPath, keyPath, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same path on the HTTPS
+// server listening at addr.
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}